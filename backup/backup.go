@@ -0,0 +1,248 @@
+package backup
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+const (
+	FormatVersion = "v1"
+	ManifestFile  = "manifest.json"
+
+	// EntryObject holds the full object, it is deleted by the removal
+	EntryObject = "object"
+	// EntryMarks holds the original labels, annotations and finalizers of an object
+	// the removal strips Rancher marks from
+	EntryMarks = "marks"
+)
+
+type Entry struct {
+	Type      string `json:"type"`
+	Phase     string `json:"phase"`
+	Group     string `json:"group,omitempty"`
+	Version   string `json:"version"`
+	Resource  string `json:"resource"`
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name"`
+	File      string `json:"file"`
+}
+
+type Manifest struct {
+	FormatVersion string    `json:"formatVersion"`
+	ToolVersion   string    `json:"toolVersion"`
+	CreatedAt     time.Time `json:"createdAt"`
+	Namespace     string    `json:"namespace"`
+	Entries       []Entry   `json:"entries"`
+}
+
+func (e Entry) GVR() schema.GroupVersionResource {
+	return schema.GroupVersionResource{
+		Group:    e.Group,
+		Version:  e.Version,
+		Resource: e.Resource,
+	}
+}
+
+// Writer streams a gzipped tarball of objects, the manifest is written last
+// when the writer is closed.
+type Writer struct {
+	file     *os.File
+	gz       *gzip.Writer
+	tw       *tar.Writer
+	manifest Manifest
+	files    map[string]bool
+}
+
+func NewWriter(fileName, toolVersion, namespace string) (*Writer, error) {
+	// the backup holds the secrets of the removed namespaces
+	f, err := os.OpenFile(fileName, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if os.IsExist(err) {
+		return nil, fmt.Errorf("backup file [%s] already exists", fileName)
+	}
+	if err != nil {
+		return nil, err
+	}
+	gz := gzip.NewWriter(f)
+	return &Writer{
+		file: f,
+		gz:   gz,
+		tw:   tar.NewWriter(gz),
+		manifest: Manifest{
+			FormatVersion: FormatVersion,
+			ToolVersion:   toolVersion,
+			CreatedAt:     time.Now().UTC(),
+			Namespace:     namespace,
+			Entries:       []Entry{},
+		},
+		files: map[string]bool{},
+	}, nil
+}
+
+func (w *Writer) Has(entryType string, gvr schema.GroupVersionResource, namespace, name string) bool {
+	return w.files[entryFileName(entryType, gvr, namespace, name)]
+}
+
+func (w *Writer) AddObject(phase string, gvr schema.GroupVersionResource, obj *unstructured.Unstructured) error {
+	return w.add(EntryObject, phase, gvr, obj)
+}
+
+func (w *Writer) AddMarks(phase string, gvr schema.GroupVersionResource, obj *unstructured.Unstructured) error {
+	marks := &unstructured.Unstructured{}
+	marks.SetAPIVersion(obj.GetAPIVersion())
+	marks.SetKind(obj.GetKind())
+	marks.SetNamespace(obj.GetNamespace())
+	marks.SetName(obj.GetName())
+	marks.SetLabels(obj.GetLabels())
+	marks.SetAnnotations(obj.GetAnnotations())
+	marks.SetFinalizers(obj.GetFinalizers())
+	return w.add(EntryMarks, phase, gvr, marks)
+}
+
+func (w *Writer) add(entryType, phase string, gvr schema.GroupVersionResource, obj *unstructured.Unstructured) error {
+	fileName := entryFileName(entryType, gvr, obj.GetNamespace(), obj.GetName())
+	if w.files[fileName] {
+		return nil
+	}
+	data, err := yaml.Marshal(obj.Object)
+	if err != nil {
+		return err
+	}
+	if err := w.writeFile(fileName, data); err != nil {
+		return err
+	}
+	w.files[fileName] = true
+	w.manifest.Entries = append(w.manifest.Entries, Entry{
+		Type:      entryType,
+		Phase:     phase,
+		Group:     gvr.Group,
+		Version:   gvr.Version,
+		Resource:  gvr.Resource,
+		Kind:      obj.GetKind(),
+		Namespace: obj.GetNamespace(),
+		Name:      obj.GetName(),
+		File:      fileName,
+	})
+	return nil
+}
+
+func (w *Writer) writeFile(fileName string, data []byte) error {
+	if err := w.tw.WriteHeader(&tar.Header{
+		Name:    fileName,
+		Mode:    0600,
+		Size:    int64(len(data)),
+		ModTime: time.Now(),
+	}); err != nil {
+		return err
+	}
+	_, err := w.tw.Write(data)
+	return err
+}
+
+func (w *Writer) Close() error {
+	defer w.file.Close()
+	data, err := json.MarshalIndent(w.manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := w.writeFile(ManifestFile, data); err != nil {
+		return err
+	}
+	if err := w.tw.Close(); err != nil {
+		return err
+	}
+	if err := w.gz.Close(); err != nil {
+		return err
+	}
+	return w.file.Sync()
+}
+
+// Archive is a backup read back in memory, Files is keyed by the entry file name.
+type Archive struct {
+	Manifest Manifest
+	Files    map[string][]byte
+}
+
+func Read(fileName string) (*Archive, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	archive := &Archive{Files: map[string][]byte{}}
+	hasManifest := false
+	tr := tar.NewReader(gz)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		if h.Name == ManifestFile {
+			if err := json.Unmarshal(data, &archive.Manifest); err != nil {
+				return nil, fmt.Errorf("failed to read backup manifest: %v", err)
+			}
+			hasManifest = true
+			continue
+		}
+		archive.Files[h.Name] = data
+	}
+	if !hasManifest {
+		return nil, fmt.Errorf("backup [%s] has no manifest", fileName)
+	}
+	if archive.Manifest.FormatVersion != FormatVersion {
+		return nil, fmt.Errorf("unsupported backup format version [%s]", archive.Manifest.FormatVersion)
+	}
+	return archive, nil
+}
+
+// Object decodes the object stored for a manifest entry.
+func (a *Archive) Object(entry Entry) (*unstructured.Unstructured, error) {
+	data, ok := a.Files[entry.File]
+	if !ok {
+		return nil, fmt.Errorf("backup file [%s] is missing", entry.File)
+	}
+	jsonData, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode backup file [%s]: %v", entry.File, err)
+	}
+	obj := &unstructured.Unstructured{}
+	if err := obj.UnmarshalJSON(jsonData); err != nil {
+		return nil, fmt.Errorf("failed to decode backup file [%s]: %v", entry.File, err)
+	}
+	return obj, nil
+}
+
+func entryFileName(entryType string, gvr schema.GroupVersionResource, namespace, name string) string {
+	group := gvr.Group
+	if len(group) == 0 {
+		group = "core"
+	}
+	if len(namespace) == 0 {
+		namespace = "_cluster"
+	}
+	return path.Join(entryType, group, gvr.Version, gvr.Resource, namespace, name+".yaml")
+}
@@ -83,3 +83,11 @@ func GetCustomClientSet(kubeconfig string) (*kubernetes.Clientset, error) {
 	// create the clientset
 	return kubernetes.NewForConfig(config)
 }
+
+func GetDynamicClient(ctx *cli.Context) (dynamic.Interface, error) {
+	restConfig, err := GetRestConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return dynamic.NewForConfig(restConfig)
+}
@@ -0,0 +1,213 @@
+package logs
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// archive is the logs tarball shared by the node collectors, every entry is
+// written whole under the lock so the entries of different nodes don't mix.
+// Files go through the redactor on their way in, and are listed with their
+// size and checksum for the manifest.
+type archive struct {
+	mu       sync.Mutex
+	f        *os.File
+	zw       io.WriteCloser
+	tw       *tar.Writer
+	redactor *redactor
+	files    []ManifestFile
+}
+
+// newArchive picks the compression from the extension of the tarball, other
+// names get a plain tarball.
+func newArchive(path string, rd *redactor) (*archive, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	a := &archive{f: f, redactor: rd, files: []ManifestFile{}}
+	var w io.Writer = f
+	name := strings.ToLower(path)
+	switch {
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		a.zw = gzip.NewWriter(f)
+		w = a.zw
+	case strings.HasSuffix(name, ".tar.zst"), strings.HasSuffix(name, ".tzst"):
+		if a.zw, err = zstd.NewWriter(f); err != nil {
+			f.Close()
+			return nil, err
+		}
+		w = a.zw
+	}
+	a.tw = tar.NewWriter(w)
+	return a, nil
+}
+
+func (a *archive) addFile(name string, data []byte) error {
+	redacted := bytes.Buffer{}
+	if err := a.redactor.redact(name, bytes.NewReader(data), &redacted); err != nil {
+		return err
+	}
+	return a.writeFile(name, redacted.Bytes())
+}
+
+// writeFile adds a file as it is.
+func (a *archive) writeFile(name string, data []byte) error {
+	return a.addEntry(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: time.Now(),
+	}, bytes.NewReader(data))
+}
+
+// addTar copies the entries of a node tarball into the archive. Each entry is
+// spooled to a temporary file first, so a stream that breaks halfway through
+// an entry leaves the archive well-formed.
+func (a *archive) addTar(r io.Reader) error {
+	spool, err := ioutil.TempFile("", "system-tools-logs-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if h.Typeflag != tar.TypeReg && h.Typeflag != tar.TypeRegA {
+			h.Size = 0
+			if err := a.addEntry(h, tr); err != nil {
+				return err
+			}
+			continue
+		}
+		if h.Name, h.Size, err = a.spool(spool, h.Name, tr); err != nil {
+			return err
+		}
+		if err := a.addEntry(h, spool); err != nil {
+			return err
+		}
+	}
+}
+
+// addStream adds a file read from a stream of unknown size, spooled to a
+// temporary file first like the entries of addTar.
+func (a *archive) addStream(name string, r io.Reader) error {
+	spool, err := ioutil.TempFile("", "system-tools-logs-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+	name, size, err := a.spool(spool, name, r)
+	if err != nil {
+		return err
+	}
+	return a.addEntry(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    size,
+		ModTime: time.Now(),
+	}, spool)
+}
+
+// spool writes a redacted file to the spool and rewinds it. Gzipped files
+// are decompressed to be redacted, and lose their .gz suffix.
+func (a *archive) spool(spool *os.File, name string, r io.Reader) (string, int64, error) {
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return "", 0, err
+	}
+	if err := spool.Truncate(0); err != nil {
+		return "", 0, err
+	}
+	if strings.HasSuffix(name, ".gz") {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return "", 0, fmt.Errorf("failed to decompress [%s]: %v", name, err)
+		}
+		defer gz.Close()
+		name = strings.TrimSuffix(name, ".gz")
+		r = gz
+	}
+	if err := a.redactor.redact(name, r, spool); err != nil {
+		return "", 0, err
+	}
+	size, err := spool.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return "", 0, err
+	}
+	_, err = spool.Seek(0, io.SeekStart)
+	return name, size, err
+}
+
+func (a *archive) addEntry(h *tar.Header, r io.Reader) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.tw.WriteHeader(h); err != nil {
+		return err
+	}
+	hash := sha256.New()
+	if _, err := io.CopyN(io.MultiWriter(a.tw, hash), r, h.Size); err != nil {
+		return err
+	}
+	if h.Typeflag == tar.TypeReg || h.Typeflag == tar.TypeRegA {
+		a.files = append(a.files, ManifestFile{
+			Name:   h.Name,
+			Size:   h.Size,
+			SHA256: hex.EncodeToString(hash.Sum(nil)),
+		})
+	}
+	return nil
+}
+
+// close adds the redaction summary and the manifest, and completes the tarball.
+func (a *archive) close(m *Manifest) error {
+	summary, err := a.redactor.summary()
+	if err != nil {
+		return err
+	}
+	if err := a.writeFile(redactionSummaryName, summary); err != nil {
+		return err
+	}
+	m.FinishedAt = time.Now().UTC()
+	m.Files = a.files
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := a.writeFile(manifestName, data); err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	err = a.tw.Close()
+	if a.zw != nil {
+		if zerr := a.zw.Close(); err == nil {
+			err = zerr
+		}
+	}
+	if ferr := a.f.Close(); err == nil {
+		err = ferr
+	}
+	return err
+}
@@ -0,0 +1,334 @@
+package logs
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"github.com/rancher/system-tools/clients"
+	"github.com/rancher/system-tools/utils"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	clusterStateDir = "cluster"
+
+	// RKE keeps the cluster state, certificates included, in this configmap
+	fullStateConfigMapName      = "full-cluster-state"
+	fullStateConfigMapNamespace = "kube-system"
+	cattleAgentNamespace        = "cattle-system"
+
+	// bytes of previous container logs read per container
+	previousLogLimit = 10 << 20
+)
+
+var (
+	nodeGVR       = schema.GroupVersionResource{Version: "v1", Resource: "nodes"}
+	eventGVR      = schema.GroupVersionResource{Version: "v1", Resource: "events"}
+	podGVR        = schema.GroupVersionResource{Version: "v1", Resource: "pods"}
+	configMapGVR  = schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}
+	deploymentGVR = schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}
+	daemonSetGVR  = schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "daemonsets"}
+)
+
+// custom resources that hold credentials in clear, their status included
+var skippedCustomResources = map[string]bool{
+	"clusterregistrationtokens.management.cattle.io": true,
+	"tokens.management.cattle.io":                    true,
+}
+
+// namespaces whose pods are collected, with their previous container logs
+var systemNamespaces = []string{
+	"kube-system",
+	"cattle-system",
+	"cattle-fleet-system",
+	"cattle-fleet-local-system",
+	"ingress-nginx",
+}
+
+// clusterState gathers the cluster/ section of the logs tarball through the
+// Kubernetes API, the sections that fail are listed in cluster/errors.txt.
+type clusterState struct {
+	client     *kubernetes.Clientset
+	dynClient  dynamic.Interface
+	discClient *discovery.DiscoveryClient
+	tarball    *archive
+	window     *logWindow
+	errs       []string
+}
+
+// collectClusterState returns the errors of the sections that failed.
+func collectClusterState(ctx *cli.Context, client *kubernetes.Clientset, tarball *archive, window *logWindow) []string {
+	dynClient, err := clients.GetDynamicClient(ctx)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	discClient, err := clients.GetDiscoveryClient(ctx)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	s := &clusterState{
+		client:     client,
+		dynClient:  dynClient,
+		discClient: discClient,
+		tarball:    tarball,
+		window:     window,
+	}
+	logrus.Infof("collecting cluster state..")
+	s.section("nodes", s.collectNodes)
+	s.section("events", s.collectEvents)
+	s.section("system pods", s.collectSystemPods)
+	s.section("cattle agents", s.collectCattleAgents)
+	s.section("custom resources", s.collectCRDs)
+	s.section("full cluster state", s.collectFullClusterState)
+	if len(s.errs) != 0 {
+		if err := s.tarball.addFile(path.Join(clusterStateDir, "errors.txt"), []byte(strings.Join(s.errs, "\n")+"\n")); err != nil {
+			s.errs = append(s.errs, err.Error())
+		}
+		logrus.Warnf("%d sections of the cluster state failed, see %s/errors.txt in the logs tarball", len(s.errs), clusterStateDir)
+		return s.errs
+	}
+	logrus.Infof("collected cluster state")
+	return nil
+}
+
+func (s *clusterState) section(name string, collect func() error) {
+	if err := collect(); err != nil {
+		logrus.Warnf("failed to collect %s: %v", name, err)
+		s.errs = append(s.errs, fmt.Sprintf("%s: %v", name, err))
+	}
+}
+
+// addList writes objects the way kubectl get -o yaml prints them.
+func (s *clusterState) addList(name string, items []unstructured.Unstructured) error {
+	list := map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "List",
+		"items":      []interface{}{},
+	}
+	for _, item := range items {
+		unstructured.RemoveNestedField(item.Object, "metadata", "managedFields")
+		s.tarball.redactor.redactEnv(path.Join(clusterStateDir, name), item.Object)
+		list["items"] = append(list["items"].([]interface{}), item.Object)
+	}
+	data, err := yaml.Marshal(list)
+	if err != nil {
+		return err
+	}
+	return s.tarball.addFile(path.Join(clusterStateDir, name), data)
+}
+
+func (s *clusterState) list(gvr schema.GroupVersionResource, namespace string) ([]unstructured.Unstructured, error) {
+	list, err := s.dynClient.Resource(gvr).Namespace(namespace).List(v1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+func (s *clusterState) collectNodes() error {
+	nodes, err := s.list(nodeGVR, "")
+	if err != nil {
+		return err
+	}
+	return s.addList("nodes.yaml", nodes)
+}
+
+// collectEvents collects the events of every namespace, inside the log window
+// when one is set.
+func (s *clusterState) collectEvents() error {
+	events, err := s.list(eventGVR, "")
+	if err != nil {
+		return err
+	}
+	inWindow := []unstructured.Unstructured{}
+	for _, event := range events {
+		timestamp, _, _ := unstructured.NestedString(event.Object, "lastTimestamp")
+		if len(timestamp) == 0 {
+			timestamp, _, _ = unstructured.NestedString(event.Object, "eventTime")
+		}
+		if t, err := time.Parse(time.RFC3339, timestamp); err == nil && !s.window.contains(t) {
+			continue
+		}
+		inWindow = append(inWindow, event)
+	}
+	return s.addList("events.yaml", inWindow)
+}
+
+func (s *clusterState) collectSystemPods() error {
+	for _, namespace := range systemNamespaces {
+		pods, err := s.list(podGVR, namespace)
+		if err != nil {
+			return err
+		}
+		if len(pods) == 0 {
+			continue
+		}
+		if err := s.addList(path.Join("pods", namespace+".yaml"), pods); err != nil {
+			return err
+		}
+		for _, pod := range pods {
+			s.collectPreviousLogs(pod)
+		}
+	}
+	return nil
+}
+
+// collectPreviousLogs collects the logs of the previous instance of every
+// restarted container of a pod. The runtime may have removed them already,
+// so a missing log is only logged.
+func (s *clusterState) collectPreviousLogs(pod unstructured.Unstructured) {
+	statuses, _, _ := unstructured.NestedSlice(pod.Object, "status", "containerStatuses")
+	initStatuses, _, _ := unstructured.NestedSlice(pod.Object, "status", "initContainerStatuses")
+	for _, status := range append(statuses, initStatuses...) {
+		container, _ := status.(map[string]interface{})
+		name, _ := container["name"].(string)
+		if restarts, _ := container["restartCount"].(int64); restarts == 0 || len(name) == 0 {
+			continue
+		}
+		limit := int64(previousLogLimit)
+		options := &corev1.PodLogOptions{
+			Container:  name,
+			Previous:   true,
+			LimitBytes: &limit,
+		}
+		if !s.window.since.IsZero() {
+			options.SinceTime = &v1.Time{Time: s.window.since}
+		}
+		logName := path.Join(clusterStateDir, "pods", pod.GetNamespace(), pod.GetName(), name+"-previous.log")
+		stream, err := s.client.CoreV1().Pods(pod.GetNamespace()).GetLogs(pod.GetName(), options).Stream()
+		if err != nil {
+			logrus.Warnf("can't read previous logs of container [%s] of pod [%s/%s]: %v", name, pod.GetNamespace(), pod.GetName(), err)
+			continue
+		}
+		err = s.tarball.addStream(logName, stream)
+		stream.Close()
+		if err != nil {
+			logrus.Warnf("can't read previous logs of container [%s] of pod [%s/%s]: %v", name, pod.GetNamespace(), pod.GetName(), err)
+		}
+	}
+}
+
+func (s *clusterState) collectCattleAgents() error {
+	agents := []unstructured.Unstructured{}
+	for _, gvr := range []schema.GroupVersionResource{deploymentGVR, daemonSetGVR} {
+		items, err := s.list(gvr, cattleAgentNamespace)
+		if err != nil {
+			return err
+		}
+		agents = append(agents, items...)
+	}
+	return s.addList("cattle-agents.yaml", agents)
+}
+
+// collectCRDs collects the custom resources of the cattle.io groups, the
+// rke.cattle.io ones included, with their status, except the tokens. The CRDs are read in the
+// apiextensions version the cluster prefers.
+func (s *clusterState) collectCRDs() error {
+	groups, err := s.discClient.ServerGroups()
+	if err != nil {
+		return err
+	}
+	version := ""
+	for _, group := range groups.Groups {
+		if group.Name == "apiextensions.k8s.io" {
+			version = group.PreferredVersion.Version
+		}
+	}
+	if len(version) == 0 {
+		return fmt.Errorf("the cluster doesn't serve apiextensions.k8s.io")
+	}
+	crdGVR := schema.GroupVersionResource{Group: "apiextensions.k8s.io", Version: version, Resource: "customresourcedefinitions"}
+	crds, err := s.list(crdGVR, "")
+	if err != nil {
+		return err
+	}
+	sort.Slice(crds, func(i, j int) bool {
+		return crds[i].GetName() < crds[j].GetName()
+	})
+	failed := []string{}
+	for _, crd := range crds {
+		gvr, ok := customResourceGVR(crd)
+		if !ok || !utils.IsCattleDomain(gvr.Group) || skippedCustomResources[crd.GetName()] {
+			continue
+		}
+		items, err := s.list(gvr, "")
+		if err == nil {
+			err = s.addList(path.Join("crds", crd.GetName()+".yaml"), items)
+		}
+		if err != nil {
+			logrus.Warnf("failed to collect [%s]: %v", crd.GetName(), err)
+			failed = append(failed, crd.GetName())
+		}
+	}
+	if len(failed) != 0 {
+		return fmt.Errorf("failed to collect the custom resources of %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// customResourceGVR returns the resource of a CRD in its storage version, or
+// the first served one.
+func customResourceGVR(crd unstructured.Unstructured) (schema.GroupVersionResource, bool) {
+	group, _, _ := unstructured.NestedString(crd.Object, "spec", "group")
+	plural, _, _ := unstructured.NestedString(crd.Object, "spec", "names", "plural")
+	// v1beta1 CRDs may only set spec.version
+	version, _, _ := unstructured.NestedString(crd.Object, "spec", "version")
+	versions, _, _ := unstructured.NestedSlice(crd.Object, "spec", "versions")
+	for _, v := range versions {
+		crdVersion, _ := v.(map[string]interface{})
+		name, _ := crdVersion["name"].(string)
+		if served, _ := crdVersion["served"].(bool); !served {
+			continue
+		}
+		if storage, _ := crdVersion["storage"].(bool); storage || len(version) == 0 {
+			version = name
+		}
+	}
+	if len(plural) == 0 || len(version) == 0 {
+		return schema.GroupVersionResource{}, false
+	}
+	return schema.GroupVersionResource{Group: group, Version: version, Resource: plural}, true
+}
+
+// collectFullClusterState collects the metadata of the RKE full-cluster-state
+// configmap and the size of its keys, its data holds the cluster certificates.
+func (s *clusterState) collectFullClusterState() error {
+	configMap, err := s.dynClient.Resource(configMapGVR).Namespace(fullStateConfigMapNamespace).Get(fullStateConfigMapName, v1.GetOptions{})
+	if errors.IsNotFound(err) {
+		logrus.Debugf("no [%s] configmap, the cluster isn't an RKE cluster", fullStateConfigMapName)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	data, _, _ := unstructured.NestedStringMap(configMap.Object, "data")
+	sizes := map[string]int{}
+	for key, value := range data {
+		sizes[key] = len(value)
+	}
+	metadata, _, _ := unstructured.NestedMap(configMap.Object, "metadata")
+	delete(metadata, "managedFields")
+	out, err := yaml.Marshal(map[string]interface{}{
+		"apiVersion": configMap.GetAPIVersion(),
+		"kind":       configMap.GetKind(),
+		"metadata":   metadata,
+		"dataSizes":  sizes,
+	})
+	if err != nil {
+		return err
+	}
+	return s.tarball.addFile(path.Join(clusterStateDir, fullStateConfigMapName+".yaml"), out)
+}
@@ -1,10 +1,11 @@
 package logs
 
 import (
-	"bytes"
 	"fmt"
-	"os"
+	"io"
 	"path"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/rancher/system-tools/clients"
@@ -13,15 +14,22 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
 	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 )
 
 const (
 	LogCollectorDSName      = "log-collector"
-	LogCollectorDSNamespace = "cattle-system"
+	LogCollectorDSNamespace = "kube-system"
 	LogCollectorSelector    = "k8s-app=log-collector"
+
+	DefaultLogWorkers = 10
+
+	// time format of the log window passed to the collector pods, in UTC
+	windowTimeFormat = "2006-01-02T15:04:05"
 )
 
 var LogFlags = []cli.Flag{
@@ -32,13 +40,47 @@ var LogFlags = []cli.Flag{
 	},
 	cli.StringFlag{
 		Name:  "output,o",
-		Usage: "cluster logs tarball",
+		Usage: "cluster logs tarball, gzipped when it ends with .tar.gz or .tgz and zstd compressed when it ends with .tar.zst or .tzst",
 		Value: "cluster-logs.tar",
 	},
 	cli.StringFlag{
 		Name:  "node,n",
 		Usage: "fetch logs for a single node",
 	},
+	cli.StringFlag{
+		Name:  "image",
+		Usage: "image of the log collector pods (default: the cluster agent image)",
+	},
+	cli.IntFlag{
+		Name:  "workers",
+		Usage: "number of nodes whose logs are fetched in parallel",
+		Value: DefaultLogWorkers,
+	},
+	cli.StringFlag{
+		Name:  "profile",
+		Usage: "host profile of the data collected on each node: minimal, default, full, or a custom profile file",
+		Value: DefaultHostProfile,
+	},
+	cli.StringFlag{
+		Name:  "redaction-rules",
+		Usage: "YAML file of regex redaction rules applied along with the default ones",
+	},
+	cli.StringFlag{
+		Name:  "since",
+		Usage: "only collect log lines written after this RFC3339 time, or this long ago, e.g. 2h",
+	},
+	cli.StringFlag{
+		Name:  "until",
+		Usage: "only collect log lines written before this RFC3339 time, or this long ago, e.g. 30m",
+	},
+}
+
+// collection profile of each cluster provider
+var collectorScripts = map[string]string{
+	utils.RKECluster:     templates.RKELogCollectorScript,
+	utils.RKE2Cluster:    templates.RKE2LogCollectorScript,
+	utils.K3sCluster:     templates.K3sLogCollectorScript,
+	utils.KubeadmCluster: templates.KubeadmLogCollectorScript,
 }
 
 func DoLogs(ctx *cli.Context) error {
@@ -47,6 +89,22 @@ func DoLogs(ctx *cli.Context) error {
 		return fmt.Errorf("Please choose an output file name for the logs tarball")
 	}
 	fetchNode := ctx.String("node")
+	workers := ctx.Int("workers")
+	if workers < 1 {
+		return fmt.Errorf("--workers must be at least 1")
+	}
+	window, err := getLogWindow(ctx.String("since"), ctx.String("until"), time.Now())
+	if err != nil {
+		return err
+	}
+	rd, err := newRedactor(ctx.String("redaction-rules"))
+	if err != nil {
+		return err
+	}
+	profile, err := getHostProfile(ctx.String("profile"))
+	if err != nil {
+		return err
+	}
 
 	client, err := clients.GetClientSet(ctx)
 	if err != nil {
@@ -56,13 +114,27 @@ func DoLogs(ctx *cli.Context) error {
 	if err != nil {
 		return err
 	}
-	// check if we support this cluster, we only support RKE at the moment
-	_, err = utils.GetClusterProvider(client)
+	provider, err := utils.GetClusterProvider(client)
 	if err != nil {
 		return err
 	}
+	logrus.Infof("collecting logs of %s cluster", provider)
+	kubernetesVersion := ""
+	if version, err := client.Discovery().ServerVersion(); err != nil {
+		logrus.Warnf("can't read the Kubernetes version: %v", err)
+	} else {
+		kubernetesVersion = version.GitVersion
+	}
+	manifest := newManifest(ctx.App.Version, provider, kubernetesVersion, ctx.String("profile"), window)
+	image := ctx.String("image")
+	if len(image) == 0 {
+		if image, err = utils.GetClusterAgentImage(client); err != nil {
+			return fmt.Errorf("%v, use --image to set the log collector image", err)
+		}
+	}
 
-	if err := deployLogCollectors(client); err != nil && !errors.IsAlreadyExists(err) {
+	script := collectorScripts[provider] + profile.script() + templates.LogCollectorTail
+	if err := deployLogCollectors(client, image, script, window.env()); err != nil && !errors.IsAlreadyExists(err) {
 		return err
 	}
 	defer deleteLogCollectors(client)
@@ -71,52 +143,173 @@ func DoLogs(ctx *cli.Context) error {
 	if err != nil {
 		return err
 	}
-	f, err := os.Create(logTarball)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-	buf := bytes.Buffer{}
 	// fetch log files
 	ownerUID, err := utils.GetCollectorDSUID(client, LogCollectorDSName, LogCollectorDSNamespace)
 	if err != nil {
 		return err
 	}
-	logrus.Infof("starting log collection..")
+	pods := []corev1.Pod{}
 	for _, pod := range podList.Items {
 		// ignore pods that we didn't run
 		if pod.GetOwnerReferences()[0].UID != ownerUID {
 			continue
 		}
-		nodeName := pod.Spec.NodeName
-		if len(fetchNode) != 0 && nodeName != fetchNode {
+		if len(fetchNode) != 0 && pod.Spec.NodeName != fetchNode {
 			continue
 		}
-		logrus.Infof("fetching logs from node [%s]..", nodeName)
-		fileName := fmt.Sprintf("%s.tar", nodeName)
+		pods = append(pods, pod)
+	}
+	if len(pods) == 0 {
+		return fmt.Errorf("no log collector pod found for the selected nodes")
+	}
 
-		if err := utils.ReadFileFromPod(restConfig, pod, path.Join("/tmp/", fileName), &buf); err != nil {
-			return err
-		}
-		if err := utils.AddToTarBall(f, &buf); err != nil {
-			return err
+	tarball, err := newArchive(logTarball, rd)
+	if err != nil {
+		return err
+	}
+	for _, err := range collectClusterState(ctx, client, tarball, window) {
+		manifest.ClusterStateErrors = append(manifest.ClusterStateErrors, rd.redactString(manifestName, err))
+	}
+	logrus.Infof("starting log collection..")
+	failed := []string{}
+	for _, node := range collectLogs(restConfig, pods, tarball, workers) {
+		if node.Status == NodeStatusFailed {
+			failed = append(failed, node.Name)
+			node.Error = rd.redactString(manifestName, node.Error)
 		}
-		f.Sync()
-		buf.Reset()
+		manifest.Nodes = append(manifest.Nodes, node)
+	}
+	if err := tarball.close(manifest); err != nil {
+		return fmt.Errorf("failed to write logs tarball [%s]: %v", logTarball, err)
 	}
 	logrus.Infof("Cluster logs saved in [%s]", logTarball)
+	if len(failed) != 0 {
+		return fmt.Errorf("failed to fetch logs from nodes %v, see their error entries in the logs tarball", failed)
+	}
 	return nil
 }
 
-func deployLogCollectors(client *kubernetes.Clientset) error {
-	logrus.Infof("deploying log collection DaemonSet [%s]..", LogCollectorDSName)
+// collectLogs streams the logs of every node into the tarball from the given
+// number of workers, and returns the status of each node. Each failed node
+// gets a <node>/error.txt entry with the error.
+func collectLogs(restConfig *rest.Config, pods []corev1.Pod, tarball *archive, workers int) []ManifestNode {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	nodes := []ManifestNode{}
+	queue := make(chan corev1.Pod)
+	for w := 0; w < workers && w < len(pods); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for pod := range queue {
+				nodeName := pod.Spec.NodeName
+				logrus.Infof("fetching logs from node [%s]..", nodeName)
+				node := ManifestNode{Name: nodeName, Status: NodeStatusCollected}
+				if err := fetchNodeLogs(restConfig, pod, tarball); err != nil {
+					logrus.Errorf("failed to fetch logs from node [%s]: %v", nodeName, err)
+					node.Status = NodeStatusFailed
+					node.Error = err.Error()
+					if err := tarball.addFile(path.Join(nodeName, "error.txt"), []byte(err.Error()+"\n")); err != nil {
+						logrus.Errorf("failed to add error of node [%s] to the logs tarball: %v", nodeName, err)
+					}
+				} else {
+					logrus.Infof("fetched logs from node [%s]", nodeName)
+				}
+				mu.Lock()
+				nodes = append(nodes, node)
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, pod := range pods {
+		queue <- pod
+	}
+	close(queue)
+	wg.Wait()
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].Name < nodes[j].Name
+	})
+	return nodes
+}
 
-	dsConfig := map[string]string{}
-	agentImage, err := utils.GetClusterAgentImage(client)
+// fetchNodeLogs streams the tarball the collector pod built on its node into
+// the logs tarball.
+func fetchNodeLogs(restConfig *rest.Config, pod corev1.Pod, tarball *archive) error {
+	pr, pw := io.Pipe()
+	go func() {
+		fileName := fmt.Sprintf("%s.tar", pod.Spec.NodeName)
+		pw.CloseWithError(utils.ReadFileFromPod(restConfig, pod, path.Join("/tmp/", fileName), pw))
+	}()
+	err := tarball.addTar(pr)
+	// stop the exec stream when the tarball can't take more
+	pr.CloseWithError(err)
+	return err
+}
+
+// logWindow is the time window of --since and --until, unset ends are zero.
+type logWindow struct {
+	since time.Time
+	until time.Time
+	now   time.Time
+}
+
+func getLogWindow(since, until string, now time.Time) (*logWindow, error) {
+	sinceTime, err := parseLogTime(since, now)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("invalid --since: %v", err)
+	}
+	untilTime, err := parseLogTime(until, now)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --until: %v", err)
+	}
+	if !sinceTime.IsZero() && !untilTime.IsZero() && !sinceTime.Before(untilTime) {
+		return nil, fmt.Errorf("--since must be before --until")
+	}
+	return &logWindow{since: sinceTime, until: untilTime, now: now.UTC()}, nil
+}
+
+// contains is true for times inside the window.
+func (w *logWindow) contains(t time.Time) bool {
+	return (w.since.IsZero() || !t.Before(w.since)) && (w.until.IsZero() || !t.After(w.until))
+}
+
+// env passes the window to the collector pods, which cut the logs to it on
+// the nodes.
+func (w *logWindow) env() []corev1.EnvVar {
+	env := []corev1.EnvVar{}
+	end := w.now
+	if !w.since.IsZero() {
+		env = append(env, corev1.EnvVar{Name: "SINCE", Value: w.since.Format(windowTimeFormat)})
+	}
+	if !w.until.IsZero() {
+		env = append(env, corev1.EnvVar{Name: "UNTIL", Value: w.until.Format(windowTimeFormat)})
+		end = w.until
+	}
+	// klog timestamps have no year, they are read as the year the window ends
+	env = append(env, corev1.EnvVar{Name: "YEAR", Value: fmt.Sprintf("%d", end.Year())})
+	return env
+}
+
+// parseLogTime reads an RFC3339 time, or a duration before now.
+func parseLogTime(value string, now time.Time) (time.Time, error) {
+	if len(value) == 0 {
+		return time.Time{}, nil
 	}
-	dsConfig["Image"] = agentImage
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d).UTC(), nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("[%s] is neither an RFC3339 time nor a duration", value)
+	}
+	return t.UTC(), nil
+}
+
+func deployLogCollectors(client *kubernetes.Clientset, image, script string, env []corev1.EnvVar) error {
+	logrus.Infof("deploying log collection DaemonSet [%s]..", LogCollectorDSName)
+
+	dsConfig := map[string]string{}
+	dsConfig["Image"] = image
 	dsTmplt, err := utils.CompileTemplateFromMap(templates.LogCollectorDSTemplate, dsConfig)
 	if err != nil {
 		return err
@@ -126,6 +319,9 @@ func deployLogCollectors(client *kubernetes.Clientset) error {
 	if err := utils.DecodeYamlResource(logCollectorDS, dsTmplt); err != nil {
 		return err
 	}
+	container := &logCollectorDS.Spec.Template.Spec.Containers[0]
+	container.Command = []string{"sh", "-c", script}
+	container.Env = append(container.Env, env...)
 	if _, err := client.AppsV1().DaemonSets(logCollectorDS.Namespace).Create(logCollectorDS); err != nil {
 		return err
 	}
@@ -150,22 +346,7 @@ func deployLogCollectors(client *kubernetes.Clientset) error {
 
 func deleteLogCollectors(client *kubernetes.Clientset) error {
 	logrus.Infof("removing log collection DaemonSet [%s]..", LogCollectorDSName)
-	dsConfig := map[string]string{}
-	agentImage, err := utils.GetClusterAgentImage(client)
-	if err != nil {
-		return err
-	}
-	dsConfig["Image"] = agentImage
-	dsTmplt, err := utils.CompileTemplateFromMap(templates.LogCollectorDSTemplate, dsConfig)
-	if err != nil {
-		return err
-	}
-
-	logCollectorDS := &appsv1.DaemonSet{}
-	if err := utils.DecodeYamlResource(logCollectorDS, dsTmplt); err != nil {
-		return err
-	}
-	if err := client.AppsV1().DaemonSets(logCollectorDS.Namespace).Delete(logCollectorDS.Name, &v1.DeleteOptions{}); err != nil {
+	if err := client.AppsV1().DaemonSets(LogCollectorDSNamespace).Delete(LogCollectorDSName, &v1.DeleteOptions{}); err != nil {
 		return err
 	}
 	logrus.Infof("log collection DaemonSet [%s] removed successfully..", LogCollectorDSName)
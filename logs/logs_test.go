@@ -0,0 +1,107 @@
+package logs
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGetLogWindow(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name         string
+		since, until string
+		wantSince    time.Time
+		wantUntil    time.Time
+		wantErr      bool
+	}{
+		{name: "no window"},
+		{name: "duration", since: "2h", wantSince: now.Add(-2 * time.Hour)},
+		{name: "both durations", since: "2h", until: "30m", wantSince: now.Add(-2 * time.Hour), wantUntil: now.Add(-30 * time.Minute)},
+		{
+			name:      "RFC3339 in another zone",
+			since:     "2024-05-01T10:00:00+02:00",
+			until:     "2024-05-01T11:00:00Z",
+			wantSince: time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC),
+			wantUntil: time.Date(2024, 5, 1, 11, 0, 0, 0, time.UTC),
+		},
+		{name: "since after until", since: "30m", until: "2h", wantErr: true},
+		{name: "empty window", since: "1h", until: "1h", wantErr: true},
+		{name: "invalid since", since: "yesterday", wantErr: true},
+		{name: "invalid until", until: "2024-05-01", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := getLogWindow(tt.since, tt.until, now)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected an error, got window %v - %v", w.since, w.until)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !w.since.Equal(tt.wantSince) || !w.until.Equal(tt.wantUntil) {
+				t.Errorf("window = %v - %v, want %v - %v", w.since, w.until, tt.wantSince, tt.wantUntil)
+			}
+		})
+	}
+}
+
+func TestLogWindowContains(t *testing.T) {
+	since := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	until := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		window logWindow
+		t      time.Time
+		want   bool
+	}{
+		{name: "open window", t: since, want: true},
+		{name: "inside", window: logWindow{since: since, until: until}, t: since.Add(time.Hour), want: true},
+		{name: "at since", window: logWindow{since: since, until: until}, t: since, want: true},
+		{name: "at until", window: logWindow{since: since, until: until}, t: until, want: true},
+		{name: "before", window: logWindow{since: since, until: until}, t: since.Add(-time.Second), want: false},
+		{name: "after", window: logWindow{since: since, until: until}, t: until.Add(time.Second), want: false},
+		{name: "since only", window: logWindow{since: since}, t: until.Add(time.Hour), want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.window.contains(tt.t); got != tt.want {
+				t.Errorf("contains(%v) = %t, want %t", tt.t, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLogWindowEnv(t *testing.T) {
+	now := time.Date(2025, 1, 2, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		window logWindow
+		want   map[string]string
+	}{
+		{name: "no window", window: logWindow{now: now}, want: map[string]string{"YEAR": "2025"}},
+		{
+			name:   "year of until",
+			window: logWindow{since: time.Date(2024, 12, 31, 22, 0, 0, 0, time.UTC), until: time.Date(2024, 12, 31, 23, 0, 0, 0, time.UTC), now: now},
+			want:   map[string]string{"SINCE": "2024-12-31T22:00:00", "UNTIL": "2024-12-31T23:00:00", "YEAR": "2024"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := map[string]string{}
+			for _, env := range tt.window.env() {
+				got[env.Name] = env.Value
+			}
+			if len(got) != len(tt.want) {
+				t.Errorf("env() = %v, want %v", got, tt.want)
+			}
+			for name, value := range tt.want {
+				if got[name] != value {
+					t.Errorf("env() %s = %q, want %q", name, got[name], value)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package logs
+
+import (
+	"time"
+)
+
+const (
+	manifestName = "manifest.json"
+
+	NodeStatusCollected = "collected"
+	NodeStatusFailed    = "failed"
+)
+
+// Manifest is written at the root of the logs tarball, it lists how the logs
+// were collected and every file of the tarball but itself.
+type Manifest struct {
+	ToolVersion        string         `json:"toolVersion"`
+	Provider           string         `json:"provider"`
+	KubernetesVersion  string         `json:"kubernetesVersion"`
+	Profile            string         `json:"profile"`
+	Since              *time.Time     `json:"since,omitempty"`
+	Until              *time.Time     `json:"until,omitempty"`
+	StartedAt          time.Time      `json:"startedAt"`
+	FinishedAt         time.Time      `json:"finishedAt"`
+	Nodes              []ManifestNode `json:"nodes"`
+	ClusterStateErrors []string       `json:"clusterStateErrors,omitempty"`
+	Files              []ManifestFile `json:"files"`
+}
+
+type ManifestNode struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type ManifestFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+func newManifest(toolVersion, provider, kubernetesVersion, profile string, window *logWindow) *Manifest {
+	m := &Manifest{
+		ToolVersion:       toolVersion,
+		Provider:          provider,
+		KubernetesVersion: kubernetesVersion,
+		Profile:           profile,
+		StartedAt:         time.Now().UTC(),
+		Nodes:             []ManifestNode{},
+		Files:             []ManifestFile{},
+	}
+	if !window.since.IsZero() {
+		m.Since = &window.since
+	}
+	if !window.until.IsZero() {
+		m.Until = &window.until
+	}
+	return m
+}
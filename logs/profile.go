@@ -0,0 +1,161 @@
+package logs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/rancher/system-tools/templates"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const DefaultHostProfile = "default"
+
+// built-in host profiles, selected by name with --profile
+var hostProfiles = map[string]string{
+	"minimal": templates.MinimalHostProfile,
+	"default": templates.DefaultHostProfile,
+	"full":    templates.FullHostProfile,
+}
+
+var (
+	hostCommandName = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+	journalUnitName = regexp.MustCompile(`^[A-Za-z0-9@:._-]+$`)
+)
+
+// HostProfile lists the host data collected on each node, a profile extends
+// a built-in profile with its own entries.
+type HostProfile struct {
+	Extends  string        `yaml:"extends"`
+	Journal  []string      `yaml:"journal"`
+	Commands []HostCommand `yaml:"commands"`
+	Paths    []string      `yaml:"paths"`
+}
+
+// HostCommand is run on the host, its output is collected in host/<name>.txt.
+type HostCommand struct {
+	Name    string `yaml:"name"`
+	Command string `yaml:"command"`
+}
+
+// getHostProfile loads a built-in profile by name, or a custom profile file.
+func getHostProfile(value string) (*HostProfile, error) {
+	if data, ok := hostProfiles[value]; ok {
+		return loadHostProfile(value, []byte(data), map[string]bool{})
+	}
+	data, err := ioutil.ReadFile(value)
+	if err != nil {
+		return nil, fmt.Errorf("[%s] is neither a host profile (%s) nor a readable profile file: %v", value, strings.Join(hostProfileNames(), ", "), err)
+	}
+	return loadHostProfile(value, data, map[string]bool{})
+}
+
+func hostProfileNames() []string {
+	names := []string{}
+	for name := range hostProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func loadHostProfile(name string, data []byte, loading map[string]bool) (*HostProfile, error) {
+	profile := &HostProfile{}
+	if err := yaml.UnmarshalStrict(data, profile); err != nil {
+		return nil, fmt.Errorf("invalid host profile [%s]: %v", name, err)
+	}
+	if err := profile.validate(); err != nil {
+		return nil, fmt.Errorf("invalid host profile [%s]: %v", name, err)
+	}
+	if len(profile.Extends) == 0 {
+		return profile, nil
+	}
+	baseData, ok := hostProfiles[profile.Extends]
+	if !ok {
+		return nil, fmt.Errorf("host profile [%s] extends unknown profile [%s], built-in profiles are: %s", name, profile.Extends, strings.Join(hostProfileNames(), ", "))
+	}
+	if loading[profile.Extends] {
+		return nil, fmt.Errorf("host profile [%s] extends itself", profile.Extends)
+	}
+	loading[name] = true
+	base, err := loadHostProfile(profile.Extends, []byte(baseData), loading)
+	if err != nil {
+		return nil, err
+	}
+	return base.merge(profile), nil
+}
+
+func (p *HostProfile) validate() error {
+	for _, unit := range p.Journal {
+		if !journalUnitName.MatchString(unit) {
+			return fmt.Errorf("invalid journald unit [%s]", unit)
+		}
+	}
+	for _, c := range p.Commands {
+		if !hostCommandName.MatchString(c.Name) {
+			return fmt.Errorf("invalid command name [%s], use letters, digits, dots, dashes and underscores", c.Name)
+		}
+		if len(c.Command) == 0 {
+			return fmt.Errorf("command [%s] is empty", c.Name)
+		}
+	}
+	for _, hostPath := range p.Paths {
+		if !path.IsAbs(hostPath) {
+			return fmt.Errorf("host path [%s] is not absolute", hostPath)
+		}
+	}
+	return nil
+}
+
+// merge adds the entries of a profile to its base, a command replaces the
+// base command of the same name.
+func (p *HostProfile) merge(override *HostProfile) *HostProfile {
+	merged := &HostProfile{
+		Journal: appendMissing(p.Journal, override.Journal),
+		Paths:   appendMissing(p.Paths, override.Paths),
+	}
+	index := map[string]int{}
+	for _, c := range append(p.Commands, override.Commands...) {
+		if i, ok := index[c.Name]; ok {
+			merged.Commands[i] = c
+			continue
+		}
+		index[c.Name] = len(merged.Commands)
+		merged.Commands = append(merged.Commands, c)
+	}
+	return merged
+}
+
+func appendMissing(base, items []string) []string {
+	seen := map[string]bool{}
+	merged := []string{}
+	for _, item := range append(base, items...) {
+		if !seen[item] {
+			seen[item] = true
+			merged = append(merged, item)
+		}
+	}
+	return merged
+}
+
+// script turns the profile into steps of the log collection script.
+func (p *HostProfile) script() string {
+	lines := []string{""}
+	for _, unit := range p.Journal {
+		lines = append(lines, "journal "+unit)
+	}
+	for _, c := range p.Commands {
+		lines = append(lines, fmt.Sprintf("run %s %s", c.Name, shellQuote(c.Command)))
+	}
+	for _, hostPath := range p.Paths {
+		lines = append(lines, "hostpath "+shellQuote(hostPath))
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
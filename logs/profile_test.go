@@ -0,0 +1,97 @@
+package logs
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoadHostProfile(t *testing.T) {
+	tests := []struct {
+		name         string
+		data         string
+		wantJournal  []string
+		wantCommands map[string]string
+		wantPaths    []string
+		wantErr      string
+	}{
+		{
+			name:         "standalone",
+			data:         "commands:\n- name: date\n  command: date\npaths:\n- /etc/hostname\n",
+			wantJournal:  nil,
+			wantCommands: map[string]string{"date": "date"},
+			wantPaths:    []string{"/etc/hostname"},
+		},
+		{
+			name:         "extends minimal",
+			data:         "extends: minimal\njournal:\n- sshd\ncommands:\n- name: df\n  command: df -hT\n- name: date\n  command: date\npaths:\n- /etc/os-release\n- /etc/hostname\n",
+			wantJournal:  []string{"sshd"},
+			wantCommands: map[string]string{"uname": "uname -a", "uptime": "uptime", "df": "df -hT", "free": "free -m", "date": "date"},
+			wantPaths:    []string{"/etc/os-release", "/etc/hostname"},
+		},
+		{name: "unknown base", data: "extends: everything\n", wantErr: "unknown profile"},
+		{name: "unknown field", data: "command:\n- name: date\n", wantErr: "invalid host profile"},
+		{name: "command name", data: "commands:\n- name: ../date\n  command: date\n", wantErr: "invalid command name"},
+		{name: "empty command", data: "commands:\n- name: date\n", wantErr: "is empty"},
+		{name: "relative path", data: "paths:\n- etc/hosts\n", wantErr: "not absolute"},
+		{name: "journal unit", data: "journal:\n- 'kubelet; reboot'\n", wantErr: "invalid journald unit"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			profile, err := loadHostProfile("custom", []byte(tt.data), map[string]bool{})
+			if len(tt.wantErr) != 0 {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("expected an error with %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(profile.Journal) != 0 || len(tt.wantJournal) != 0 {
+				if !reflect.DeepEqual(profile.Journal, tt.wantJournal) {
+					t.Errorf("journal = %v, want %v", profile.Journal, tt.wantJournal)
+				}
+			}
+			commands := map[string]string{}
+			for _, c := range profile.Commands {
+				if _, ok := commands[c.Name]; ok {
+					t.Errorf("command %s is listed twice", c.Name)
+				}
+				commands[c.Name] = c.Command
+			}
+			if !reflect.DeepEqual(commands, tt.wantCommands) {
+				t.Errorf("commands = %v, want %v", commands, tt.wantCommands)
+			}
+			if !reflect.DeepEqual(profile.Paths, tt.wantPaths) {
+				t.Errorf("paths = %v, want %v", profile.Paths, tt.wantPaths)
+			}
+		})
+	}
+}
+
+func TestBuiltinHostProfiles(t *testing.T) {
+	sizes := map[string]int{}
+	for _, name := range hostProfileNames() {
+		profile, err := getHostProfile(name)
+		if err != nil {
+			t.Fatalf("profile %s: %v", name, err)
+		}
+		sizes[name] = len(profile.Commands) + len(profile.Journal) + len(profile.Paths)
+	}
+	if !(sizes["minimal"] < sizes["default"] && sizes["default"] < sizes["full"]) {
+		t.Errorf("each built-in profile should extend the previous one, sizes %v", sizes)
+	}
+}
+
+func TestHostProfileScript(t *testing.T) {
+	profile := &HostProfile{
+		Journal:  []string{"kubelet"},
+		Commands: []HostCommand{{Name: "echo", Command: "echo 'it''s'"}},
+		Paths:    []string{"/etc/it's"},
+	}
+	want := "\njournal kubelet\nrun echo 'echo '\\''it'\\'''\\''s'\\'''\nhostpath '/etc/it'\\''s'\n"
+	if got := profile.script(); got != want {
+		t.Errorf("script() = %q, want %q", got, want)
+	}
+}
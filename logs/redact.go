@@ -0,0 +1,299 @@
+package logs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"sync"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	redactedValue         = "[REDACTED]"
+	redactionSummaryName  = "redaction-summary.json"
+	pemRedactionRuleName  = "pem"
+	envRedactionRuleName  = "secret-env"
+	secretKeysPattern     = `[a-z0-9_.-]*(?:password|passwd|token|secret|secret[_-]?key|access[_-]?key|api[_-]?key|private[_-]?key|client[_-]?key|encryption[_-]?key|key[_-]?pem|key[_-]?data)`
+	secretKeyValuePattern = `(?i)(` + secretKeysPattern + `\\?["']?\s*[:=]\s*`
+)
+
+var (
+	pemBegin = regexp.MustCompile(`-----BEGIN [A-Z0-9 ]+-----`)
+	pemEnd   = regexp.MustCompile(`-----END [A-Z0-9 ]+-----`)
+	// names of container env variables whose value is redacted
+	secretEnvName = regexp.MustCompile(`(?i)^` + secretKeysPattern)
+)
+
+// RedactionRule replaces the matches of Pattern with Replacement, which
+// expands $1 style submatches and is [REDACTED] when empty.
+type RedactionRule struct {
+	Name        string `yaml:"name"`
+	Pattern     string `yaml:"pattern"`
+	Replacement string `yaml:"replacement"`
+
+	re *regexp.Regexp
+}
+
+// RedactionRules is the format of the --redaction-rules file.
+type RedactionRules struct {
+	Rules []RedactionRule `yaml:"rules"`
+}
+
+var defaultRedactionRules = []RedactionRule{
+	{
+		Name:        pemRedactionRuleName,
+		Pattern:     `-----BEGIN ([A-Z0-9 ]+)-----.*?-----END [A-Z0-9 ]+-----`,
+		Replacement: "-----BEGIN $1-----" + redactedValue + "-----END $1-----",
+	},
+	{
+		Name:        "bearer-token",
+		Pattern:     `(?i)(bearer\s+)[a-z0-9._~+/-]+=*`,
+		Replacement: "${1}" + redactedValue,
+	},
+	{
+		Name:        "basic-auth",
+		Pattern:     `(?i)(authorization\\?["']?\s*[:=]\s*\\?["']?basic\s+)[a-z0-9+/]+=*`,
+		Replacement: "${1}" + redactedValue,
+	},
+	{
+		Name:        "url-credentials",
+		Pattern:     `(://[^/\s:@"']+:)[^@\s/"']+@`,
+		Replacement: "${1}" + redactedValue + "@",
+	},
+	// cluster registration tokens in the import URL and agent command lines
+	{
+		Name:        "registration-token",
+		Pattern:     `(/v3/import/)[A-Za-z0-9]+`,
+		Replacement: "${1}" + redactedValue,
+	},
+	{
+		Name:        "registration-token",
+		Pattern:     `(--token\s+)[^\s"'\\]+`,
+		Replacement: "${1}" + redactedValue,
+	},
+	{
+		Name:    "jwt",
+		Pattern: `eyJ[A-Za-z0-9_-]+\.eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+`,
+	},
+	{
+		Name:    "aws-access-key-id",
+		Pattern: `\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`,
+	},
+	// passwords, tokens and keys of the RKE cluster state, cluster.yml, cloud
+	// provider configs and command line flags, quoted values first
+	{
+		Name:        "secret-field",
+		Pattern:     secretKeyValuePattern + `")(?:[^"\\]|\\.)*"`,
+		Replacement: "${1}" + redactedValue + `"`,
+	},
+	{
+		Name:        "secret-field",
+		Pattern:     secretKeyValuePattern + `\\?["']?)[^\s"',}\\]+`,
+		Replacement: "${1}" + redactedValue,
+	},
+}
+
+// redactor runs the redaction rules on every file written to the logs
+// tarball, and counts the replacements of each rule per file.
+type redactor struct {
+	rules []RedactionRule
+
+	mu     sync.Mutex
+	counts map[string]map[string]int
+}
+
+func newRedactor(rulesFile string) (*redactor, error) {
+	rules := append([]RedactionRule{}, defaultRedactionRules...)
+	if len(rulesFile) != 0 {
+		data, err := ioutil.ReadFile(rulesFile)
+		if err != nil {
+			return nil, err
+		}
+		userRules := RedactionRules{}
+		if err := yaml.UnmarshalStrict(data, &userRules); err != nil {
+			return nil, fmt.Errorf("invalid redaction rules [%s]: %v", rulesFile, err)
+		}
+		for i, rule := range userRules.Rules {
+			if len(rule.Name) == 0 {
+				userRules.Rules[i].Name = fmt.Sprintf("rule-%d", i+1)
+			}
+		}
+		rules = append(rules, userRules.Rules...)
+	}
+	for i := range rules {
+		re, err := regexp.Compile(rules[i].Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern of redaction rule [%s]: %v", rules[i].Name, err)
+		}
+		rules[i].re = re
+		if len(rules[i].Replacement) == 0 {
+			rules[i].Replacement = redactedValue
+		}
+	}
+	return &redactor{
+		rules:  rules,
+		counts: map[string]map[string]int{},
+	}, nil
+}
+
+// redact copies a file line by line, with the rules applied. The body of a
+// PEM block spanning several lines is dropped.
+func (rd *redactor) redact(name string, r io.Reader, w io.Writer) error {
+	counts := map[string]int{}
+	defer rd.record(name, counts)
+	br := bufio.NewReader(r)
+	inPEM := false
+	for {
+		line, err := br.ReadString('\n')
+		if len(line) != 0 {
+			if _, werr := io.WriteString(w, rd.redactLine(line, &inPEM, counts)); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (rd *redactor) redactLine(line string, inPEM *bool, counts map[string]int) string {
+	if *inPEM {
+		end := pemEnd.FindStringIndex(line)
+		if end == nil {
+			return ""
+		}
+		*inPEM = false
+		line = line[end[0]:]
+	}
+	for _, rule := range rd.rules {
+		n := 0
+		for _, match := range rule.re.FindAllString(line, -1) {
+			// values redacted by an earlier rule can match again
+			if !strings.Contains(match, redactedValue) {
+				n++
+			}
+		}
+		if n != 0 {
+			line = rule.re.ReplaceAllString(line, rule.Replacement)
+			counts[rule.Name] += n
+		}
+	}
+	// a PEM block left open goes on over the next lines
+	begins := pemBegin.FindAllStringIndex(line, -1)
+	if len(begins) != 0 {
+		last := begins[len(begins)-1]
+		if pemEnd.FindStringIndex(line[last[1]:]) == nil {
+			*inPEM = true
+			counts[pemRedactionRuleName]++
+			line = line[:last[1]] + redactedValue + "\n"
+		}
+	}
+	return line
+}
+
+// redactString redacts a value written to a file of the tarball outside of
+// the redactor, such as an error in the manifest.
+func (rd *redactor) redactString(name, s string) string {
+	redacted := bytes.Buffer{}
+	if err := rd.redact(name, strings.NewReader(s), &redacted); err != nil {
+		return redactedValue
+	}
+	return redacted.String()
+}
+
+// redactEnv redacts the values of the secret-like env variables of the
+// containers of an object, the rules only see one line of the name and value
+// pairs once they are written as YAML.
+func (rd *redactor) redactEnv(name string, obj interface{}) {
+	counts := map[string]int{}
+	redactEnvValues(obj, counts)
+	rd.record(name, counts)
+}
+
+func redactEnvValues(obj interface{}, counts map[string]int) {
+	switch value := obj.(type) {
+	case map[string]interface{}:
+		for key, field := range value {
+			if env, ok := field.([]interface{}); ok && key == "env" {
+				redactEnvList(env, counts)
+			}
+			redactEnvValues(field, counts)
+		}
+	case []interface{}:
+		for _, item := range value {
+			redactEnvValues(item, counts)
+		}
+	}
+}
+
+func redactEnvList(env []interface{}, counts map[string]int) {
+	for _, item := range env {
+		variable, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		name, _ := variable["name"].(string)
+		value, ok := variable["value"].(string)
+		if !ok || len(value) == 0 || value == redactedValue || !secretEnvName.MatchString(name) {
+			continue
+		}
+		variable["value"] = redactedValue
+		counts[envRedactionRuleName]++
+	}
+}
+
+func (rd *redactor) record(name string, counts map[string]int) {
+	if len(counts) == 0 {
+		return
+	}
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+	if rd.counts[name] == nil {
+		rd.counts[name] = map[string]int{}
+	}
+	for rule, n := range counts {
+		rd.counts[name][rule] += n
+	}
+}
+
+// summary lists the rules and how many values each redacted, in total and per
+// file, without any of the original values.
+func (rd *redactor) summary() ([]byte, error) {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+	type ruleSummary struct {
+		Name    string `json:"name"`
+		Pattern string `json:"pattern"`
+		Count   int    `json:"count"`
+	}
+	rules := []ruleSummary{}
+	seen := map[string]int{}
+	for _, rule := range rd.rules {
+		if i, ok := seen[rule.Name]; ok {
+			rules[i].Pattern += " | " + rule.Pattern
+			continue
+		}
+		seen[rule.Name] = len(rules)
+		rules = append(rules, ruleSummary{Name: rule.Name, Pattern: rule.Pattern})
+	}
+	seen[envRedactionRuleName] = len(rules)
+	rules = append(rules, ruleSummary{Name: envRedactionRuleName, Pattern: "env value of " + secretEnvName.String()})
+	for _, counts := range rd.counts {
+		for rule, n := range counts {
+			rules[seen[rule]].Count += n
+		}
+	}
+	return json.MarshalIndent(map[string]interface{}{
+		"rules": rules,
+		"files": rd.counts,
+	}, "", "  ")
+}
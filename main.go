@@ -6,7 +6,9 @@ import (
 	"github.com/rancher/system-tools/cert"
 	"github.com/rancher/system-tools/config"
 	"github.com/rancher/system-tools/logs"
+	"github.com/rancher/system-tools/nodecleanup"
 	"github.com/rancher/system-tools/remove"
+	"github.com/rancher/system-tools/restore"
 	"github.com/rancher/system-tools/stats"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
@@ -40,15 +42,47 @@ func main() {
 			Name:   "remove",
 			Usage:  "safely remove rancher 2.x management plane",
 			Action: remove.DoRemoveRancher,
-			Flags:  append(commonFlags, remove.ForceFlag),
+			Flags:  append(commonFlags, remove.RemoveFlags...),
+			Subcommands: cli.Commands{
+				cli.Command{
+					Name:   "verify",
+					Usage:  "scan for rancher 2.x objects left after removal",
+					Action: remove.DoVerify,
+					Flags:  append(commonFlags, remove.VerifyFlags...),
+				},
+			},
+		},
+		cli.Command{
+			Name:  "namespace",
+			Usage: "namespace operations",
+			Subcommands: cli.Commands{
+				cli.Command{
+					Name:      "unstick",
+					Usage:     "resolve namespaces stuck in Terminating, all of them when no name is given",
+					ArgsUsage: "[NAMESPACE...]",
+					Action:    remove.DoUnstickNamespace,
+					Flags:     remove.UnstickFlags,
+				},
+			},
+		},
+		cli.Command{
+			Name:   "restore",
+			Usage:  "restore rancher 2.x objects from a removal backup archive",
+			Action: restore.DoRestore,
+			Flags:  restore.RestoreFlags,
 		},
-
 		cli.Command{
 			Name:   "logs",
 			Usage:  "inspect logs for rancher 2.x managed clusters",
 			Action: logs.DoLogs,
 			Flags:  logs.LogFlags,
 		},
+		cli.Command{
+			Name:   "node-cleanup",
+			Usage:  "remove rancher and kubernetes leftovers from the cluster nodes",
+			Action: nodecleanup.DoNodeCleanup,
+			Flags:  nodecleanup.NodeCleanupFlags,
+		},
 		cli.Command{
 			Name:   "stats",
 			Usage:  "show live system stats from cluster nodes",
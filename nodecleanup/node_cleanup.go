@@ -0,0 +1,529 @@
+package nodecleanup
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rancher/system-tools/clients"
+	"github.com/rancher/system-tools/templates"
+	"github.com/rancher/system-tools/utils"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	NodeCleanupDSName      = "node-cleanup"
+	NodeCleanupDSNamespace = "kube-system"
+	NodeCleanupSelector    = "k8s-app=node-cleanup"
+
+	// where the cleanup pods mount the host filesystem
+	hostRoot         = "/host"
+	hostScriptPath   = "/var/tmp/rancher-node-cleanup.sh"
+	scheduledPrefix  = "scheduled"
+	nodeStatusFailed = "failed"
+
+	// the released cleanup starts this long after the last node is released,
+	// once the DaemonSet is removed
+	startDelay = 30 * time.Second
+	// how long released worker nodes have to report their result
+	resultTimeout = 5 * time.Minute
+
+	// the node event reporting the result, see templates.NodeCleanupScript
+	cleanupEventSource  = "rancher-node-cleanup"
+	cleanupFailedReason = "NodeCleanupFailed"
+
+	etcdRoleLabel         = "node-role.kubernetes.io/etcd"
+	controlPlaneRoleLabel = "node-role.kubernetes.io/controlplane"
+	apiServerPort         = 6443
+)
+
+// cleanup steps in the order they run on each node
+var NodeCleanupSteps = []string{
+	"containers",
+	"etcd",
+	"directories",
+	"interfaces",
+	"iptables",
+}
+
+var NodeCleanupFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:   "kubeconfig,c",
+		EnvVar: "KUBECONFIG",
+		Usage:  "managed cluster kubeconfig",
+	},
+	cli.StringFlag{
+		Name:  "node,n",
+		Usage: "clean a single node",
+	},
+	cli.BoolFlag{
+		Name:  "dry-run",
+		Usage: "list what would be removed from each node without removing anything",
+	},
+	cli.StringFlag{
+		Name:  "skip",
+		Usage: "comma separated list of cleanup steps to skip: " + strings.Join(NodeCleanupSteps, ", "),
+	},
+	cli.StringFlag{
+		Name:  "image",
+		Usage: "image of the cleanup pods (default: the cluster agent image)",
+	},
+	cli.BoolFlag{
+		Name:  "force",
+		Usage: "skip the interactive cleanup confirmation",
+	},
+}
+
+type nodeResult struct {
+	node         string
+	pod          corev1.Pod
+	controlPlane bool
+	items        map[string][]string
+	log          string
+	event        string
+	released     bool
+	status       string
+	err          error
+}
+
+func DoNodeCleanup(ctx *cli.Context) error {
+	steps, err := getSteps(ctx.String("skip"))
+	if err != nil {
+		return err
+	}
+	dryRun := ctx.Bool("dry-run")
+	if !dryRun && !ctx.Bool("force") {
+		reader := bufio.NewReader(os.Stdin)
+		fmt.Printf("Are you sure you want to remove %s from the cluster nodes [y/n]: ", strings.Join(steps, ", "))
+		input, err := reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		input = strings.TrimSpace(input)
+		if input != "y" && input != "Y" {
+			return nil
+		}
+	}
+	client, err := clients.GetClientSet(ctx)
+	if err != nil {
+		return err
+	}
+	restConfig, err := clients.GetRestConfig(ctx)
+	if err != nil {
+		return err
+	}
+	// the cleanup relies on the docker host layout of RKE nodes
+	provider, err := utils.GetClusterProvider(client)
+	if err != nil {
+		return err
+	}
+	if provider != utils.RKECluster {
+		return fmt.Errorf("node cleanup only supports RKE clusters, found a %s cluster", provider)
+	}
+	image := ctx.String("image")
+	if len(image) == 0 {
+		if image, err = utils.GetClusterAgentImage(client); err != nil {
+			return fmt.Errorf("%v, use --image to set the cleanup image", err)
+		}
+	}
+
+	if err := deployNodeCleanup(client, image); err != nil && !errors.IsAlreadyExists(err) {
+		return err
+	}
+	defer deleteNodeCleanup(client, image)
+
+	ownerUID, err := utils.GetCollectorDSUID(client, NodeCleanupDSName, NodeCleanupDSNamespace)
+	if err != nil {
+		return err
+	}
+	podList, err := client.CoreV1().Pods(NodeCleanupDSNamespace).List(v1.ListOptions{LabelSelector: NodeCleanupSelector})
+	if err != nil {
+		return err
+	}
+	nodeList, err := client.CoreV1().Nodes().List(v1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	controlPlane, apiURLs := getControlPlane(nodeList.Items)
+	cleanNode := ctx.String("node")
+	pods := []corev1.Pod{}
+	for _, pod := range podList.Items {
+		// ignore pods that we didn't run
+		if pod.GetOwnerReferences()[0].UID != ownerUID {
+			continue
+		}
+		if len(cleanNode) != 0 && pod.Spec.NodeName != cleanNode {
+			continue
+		}
+		pods = append(pods, pod)
+	}
+	if len(pods) == 0 {
+		return fmt.Errorf("no cleanup pod found for the selected nodes")
+	}
+	results := scheduleNodes(restConfig, pods, image, steps, dryRun)
+	for _, result := range results {
+		result.controlPlane = controlPlane[result.node]
+	}
+	failed := countFailed(results)
+	if !dryRun && failed == 0 {
+		failed = releaseNodes(client, restConfig, results, apiURLs)
+	}
+	if !dryRun && failed != 0 {
+		cancelNodes(restConfig, results)
+	}
+	printResults(results, steps, dryRun)
+
+	if failed != 0 {
+		if dryRun {
+			return fmt.Errorf("cleanup failed on %d of %d nodes", failed, len(results))
+		}
+		return fmt.Errorf("cleanup failed on %d of %d nodes, it was cancelled on the nodes where it hadn't started", failed, len(results))
+	}
+	return nil
+}
+
+// getControlPlane returns the etcd and control plane nodes, which are
+// released last, and the API addresses the other nodes report their result to.
+func getControlPlane(nodes []corev1.Node) (map[string]bool, string) {
+	controlPlane := map[string]bool{}
+	apiURLs := []string{}
+	for _, node := range nodes {
+		if node.Labels[etcdRoleLabel] == "true" {
+			controlPlane[node.Name] = true
+		}
+		if node.Labels[controlPlaneRoleLabel] != "true" {
+			continue
+		}
+		controlPlane[node.Name] = true
+		for _, address := range node.Status.Addresses {
+			if address.Type == corev1.NodeInternalIP {
+				apiURLs = append(apiURLs, fmt.Sprintf("https://%s:%d", address.Address, apiServerPort))
+				break
+			}
+		}
+	}
+	return controlPlane, strings.Join(apiURLs, ",")
+}
+
+// scheduleNodes runs cleanupNode on every node in parallel.
+func scheduleNodes(restConfig *rest.Config, pods []corev1.Pod, image string, steps []string, dryRun bool) []*nodeResult {
+	logrus.Infof("cleaning %d nodes..", len(pods))
+	results := make([]*nodeResult, len(pods))
+	var wg sync.WaitGroup
+	for i := range pods {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = cleanupNode(restConfig, pods[i], image, steps, dryRun)
+		}(i)
+	}
+	wg.Wait()
+	return results
+}
+
+func countFailed(results []*nodeResult) int {
+	failed := 0
+	for _, result := range results {
+		if result.err != nil {
+			failed++
+		}
+	}
+	return failed
+}
+
+// releaseNodes starts the scheduled cleanup, worker nodes first. Their result
+// is collected while the cluster API is still up, and the etcd and control
+// plane nodes are only released when no worker failed. Those can't report
+// back, since the API goes away with them. It returns the number of failed
+// nodes.
+func releaseNodes(client *kubernetes.Clientset, restConfig *rest.Config, results []*nodeResult, apiURLs string) int {
+	workers := []*nodeResult{}
+	controlPlane := []*nodeResult{}
+	for _, result := range results {
+		if result.controlPlane {
+			controlPlane = append(controlPlane, result)
+		} else {
+			workers = append(workers, result)
+		}
+	}
+	if len(workers) != 0 {
+		logrus.Infof("releasing cleanup on %d worker nodes..", len(workers))
+		startAt := releaseGroup(restConfig, workers, apiURLs)
+		if countFailed(workers) != 0 {
+			return countFailed(results)
+		}
+		collectResults(client, workers, startAt)
+		if countFailed(workers) != 0 {
+			logrus.Errorf("cleanup failed on worker nodes, the etcd and control plane nodes are kept")
+			return countFailed(results)
+		}
+	}
+	if len(controlPlane) != 0 {
+		logrus.Infof("releasing cleanup on %d etcd and control plane nodes..", len(controlPlane))
+		startAt := releaseGroup(restConfig, controlPlane, "")
+		for _, result := range controlPlane {
+			if result.err == nil {
+				result.status = fmt.Sprintf("released, starts at %s, see %s on the node", startAt.Format(time.RFC3339), result.log)
+			}
+		}
+	}
+	return countFailed(results)
+}
+
+// releaseGroup starts the cleanup scheduled on the given nodes at the same
+// time, after all of them are released, so no node tears down the control
+// plane while others are still being reached. It returns the start time.
+func releaseGroup(restConfig *rest.Config, results []*nodeResult, apiURLs string) time.Time {
+	startAt := time.Now().Add(startDelay)
+	var wg sync.WaitGroup
+	for _, result := range results {
+		wg.Add(1)
+		go func(result *nodeResult) {
+			defer wg.Done()
+			// each node counts down on its own clock
+			delay := int(time.Until(startAt).Seconds())
+			result.event = fmt.Sprintf("%s.%s.%d", result.node, cleanupEventSource, startAt.Unix())
+			command := []string{"sh", hostRoot + hostScriptPath, "release", hostRoot, "", fmt.Sprintf("%d", delay), result.node, result.event}
+			if len(apiURLs) != 0 {
+				command = append(command, apiURLs)
+			}
+			buf := bytes.Buffer{}
+			if err := utils.PodExecCommand(restConfig, result.pod, command, &buf); err != nil {
+				if out := strings.TrimSpace(buf.String()); len(out) != 0 {
+					err = fmt.Errorf("%s", out)
+				}
+				result.err = fmt.Errorf("failed to release cleanup on node [%s]: %v", result.node, err)
+				return
+			}
+			result.released = true
+			result.status = "released"
+		}(result)
+	}
+	wg.Wait()
+	if countFailed(results) == 0 && time.Now().After(startAt) {
+		logrus.Warnf("releasing the nodes took longer than %s, the first nodes may have started before the last ones were released", startDelay)
+	}
+	return startAt
+}
+
+// collectResults waits for the released nodes to report the counts of removed
+// and failed items per step, as an event on their Node.
+func collectResults(client *kubernetes.Clientset, results []*nodeResult, startAt time.Time) {
+	deadline := startAt.Add(resultTimeout)
+	pending := results
+	for len(pending) != 0 && time.Now().Before(deadline) {
+		logrus.Infof("waiting for %d nodes to report their cleanup result..", len(pending))
+		time.Sleep(5 * time.Second)
+		waiting := []*nodeResult{}
+		for _, result := range pending {
+			event, err := client.CoreV1().Events(v1.NamespaceDefault).Get(result.event, v1.GetOptions{})
+			if err != nil {
+				if !errors.IsNotFound(err) {
+					logrus.Warnf("failed to get the cleanup result of node [%s]: %v", result.node, err)
+				}
+				waiting = append(waiting, result)
+				continue
+			}
+			if event.Reason == cleanupFailedReason {
+				result.err = fmt.Errorf("cleanup failed on node [%s]: %s, see %s on the node", result.node, event.Message, result.log)
+				continue
+			}
+			result.status = event.Message
+		}
+		pending = waiting
+	}
+	for _, result := range pending {
+		// the node may lack curl or be unable to reach the API
+		logrus.Warnf("node [%s] didn't report its cleanup result within %s", result.node, resultTimeout)
+		result.status = fmt.Sprintf("released, no result reported, see %s on the node", result.log)
+	}
+}
+
+// cancelNodes removes the scheduled cleanup from every node it wasn't released
+// on, a cleanup that can't be released on every node isn't started on the
+// others.
+func cancelNodes(restConfig *rest.Config, results []*nodeResult) {
+	for _, result := range results {
+		if len(result.log) == 0 || result.released {
+			continue
+		}
+		command := []string{"sh", hostRoot + hostScriptPath, "cancel", hostRoot, ""}
+		if err := utils.PodExecCommand(restConfig, result.pod, command, &bytes.Buffer{}); err != nil {
+			logrus.Errorf("failed to cancel cleanup on node [%s], it starts on its own if released: %v", result.node, err)
+			continue
+		}
+		if result.err == nil {
+			result.status = "cancelled"
+		}
+	}
+}
+
+func getSteps(skip string) ([]string, error) {
+	skipped := map[string]bool{}
+	for _, step := range strings.Split(skip, ",") {
+		step = strings.TrimSpace(step)
+		if len(step) == 0 {
+			continue
+		}
+		known := false
+		for _, s := range NodeCleanupSteps {
+			known = known || s == step
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown cleanup step [%s], valid steps are: %s", step, strings.Join(NodeCleanupSteps, ", "))
+		}
+		skipped[step] = true
+	}
+	steps := []string{}
+	for _, step := range NodeCleanupSteps {
+		if !skipped[step] {
+			steps = append(steps, step)
+		}
+	}
+	if len(steps) == 0 {
+		return nil, fmt.Errorf("all cleanup steps are skipped")
+	}
+	return steps, nil
+}
+
+// cleanupNode copies the cleanup script to the host and runs it. On a real run
+// the script schedules the removal in a detached container, since removing the
+// node containers also removes the cleanup pod. The removal waits to be
+// released by releaseNodes.
+func cleanupNode(restConfig *rest.Config, pod corev1.Pod, image string, steps []string, dryRun bool) *nodeResult {
+	result := &nodeResult{
+		node:   pod.Spec.NodeName,
+		pod:    pod,
+		items:  map[string][]string{},
+		status: nodeStatusFailed,
+	}
+	copyScript := []string{"sh", "-c", `printf '%s\n' "$1" > "$2"`, "sh", templates.NodeCleanupScript, hostRoot + hostScriptPath}
+	if err := utils.PodExecCommand(restConfig, pod, copyScript, &bytes.Buffer{}); err != nil {
+		result.err = fmt.Errorf("failed to copy cleanup script to node [%s]: %v", result.node, err)
+		return result
+	}
+	mode := "run"
+	if dryRun {
+		mode = "plan"
+	}
+	buf := bytes.Buffer{}
+	command := append([]string{"sh", hostRoot + hostScriptPath, mode, hostRoot, image}, steps...)
+	if err := utils.PodExecCommand(restConfig, pod, command, &buf); err != nil {
+		result.err = fmt.Errorf("cleanup failed on node [%s]: %v", result.node, err)
+		return result
+	}
+	for _, line := range strings.Split(buf.String(), "\n") {
+		fields := strings.SplitN(strings.TrimSpace(line), " ", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		if fields[0] == scheduledPrefix {
+			result.log = fields[1]
+			result.status = "scheduled"
+			continue
+		}
+		result.items[fields[0]] = append(result.items[fields[0]], fields[1])
+	}
+	if dryRun {
+		result.status = "dry-run"
+	} else if result.status == nodeStatusFailed {
+		result.err = fmt.Errorf("cleanup wasn't scheduled on node [%s]", result.node)
+	}
+	return result
+}
+
+func printResults(results []*nodeResult, steps []string, dryRun bool) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer tw.Flush()
+	fmt.Fprintf(tw, "NODE\t%s\tSTATUS\n", strings.ToUpper(strings.Join(steps, "\t")))
+	for _, result := range results {
+		counts := []string{}
+		for _, step := range steps {
+			counts = append(counts, fmt.Sprintf("%d", len(result.items[step])))
+		}
+		status := result.status
+		if result.err != nil {
+			status = result.err.Error()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", result.node, strings.Join(counts, "\t"), status)
+	}
+	verb := "Removing"
+	if dryRun {
+		verb = "Would remove"
+	}
+	for _, result := range results {
+		for _, step := range steps {
+			if len(result.items[step]) == 0 {
+				continue
+			}
+			fmt.Fprintf(tw, "\n%s %s on node [%s]:\n", verb, step, result.node)
+			for _, item := range result.items[step] {
+				fmt.Fprintf(tw, "  %s\n", item)
+			}
+		}
+	}
+}
+
+func getNodeCleanupDS(image string) (*appsv1.DaemonSet, error) {
+	dsConfig := map[string]string{}
+	dsConfig["Image"] = image
+	dsTmplt, err := utils.CompileTemplateFromMap(templates.NodeCleanupDSTemplate, dsConfig)
+	if err != nil {
+		return nil, err
+	}
+	nodeCleanupDS := &appsv1.DaemonSet{}
+	if err := utils.DecodeYamlResource(nodeCleanupDS, dsTmplt); err != nil {
+		return nil, err
+	}
+	return nodeCleanupDS, nil
+}
+
+func deployNodeCleanup(client *kubernetes.Clientset, image string) error {
+	logrus.Infof("deploying node cleanup DaemonSet [%s]..", NodeCleanupDSName)
+	nodeCleanupDS, err := getNodeCleanupDS(image)
+	if err != nil {
+		return err
+	}
+	if _, err := client.AppsV1().DaemonSets(nodeCleanupDS.Namespace).Create(nodeCleanupDS); err != nil {
+		return err
+	}
+	for {
+		// make sure the DaemonSet is ready
+		logrus.Infof("waiting for DaemonSet [%s] to be ready..", NodeCleanupDSName)
+		ds, err := client.AppsV1().DaemonSets(nodeCleanupDS.Namespace).Get(nodeCleanupDS.Name, v1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if ds.Status.DesiredNumberScheduled > 0 && ds.Status.DesiredNumberScheduled == ds.Status.NumberReady {
+			break
+		}
+		time.Sleep(1 * time.Second)
+	}
+	logrus.Infof("node cleanup DaemonSet [%s] deployed successfully..", NodeCleanupDSName)
+	return nil
+}
+
+func deleteNodeCleanup(client *kubernetes.Clientset, image string) error {
+	logrus.Infof("removing node cleanup DaemonSet [%s]..", NodeCleanupDSName)
+	nodeCleanupDS, err := getNodeCleanupDS(image)
+	if err != nil {
+		return err
+	}
+	if err := client.AppsV1().DaemonSets(nodeCleanupDS.Namespace).Delete(nodeCleanupDS.Name, &v1.DeleteOptions{}); err != nil {
+		return err
+	}
+	logrus.Infof("node cleanup DaemonSet [%s] removed successfully..", NodeCleanupDSName)
+	return nil
+}
@@ -0,0 +1,139 @@
+package remove
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/rancher/system-tools/backup"
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+)
+
+// namespace contents that are recreated or have no value once restored
+var skippedBackupResources = map[string]bool{
+	"events":   true,
+	"pods":     true,
+	"bindings": true,
+}
+
+func getBackupFileName(fileName string) string {
+	if len(fileName) != 0 {
+		return fileName
+	}
+	return fmt.Sprintf("rancher-removal-backup-%s.tar.gz", time.Now().UTC().Format("20060102-150405"))
+}
+
+// writeRemovalBackup saves every object the removal will delete and the
+// original marks of every object it will strip, namespaces being deleted
+// are saved along with their contents.
+func writeRemovalBackup(r *remover, fileName string) error {
+	logrus.Infof("Writing backup of Rancher objects to [%s]", fileName)
+	plan, err := buildRemovalPlan(r)
+	if err != nil {
+		return err
+	}
+	w, err := backup.NewWriter(fileName, r.ctx.App.Version, r.namespace)
+	if err != nil {
+		return err
+	}
+	if err := backupPlanObjects(r, w, plan); err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	logrus.Infof("Backup of Rancher objects saved in [%s]", fileName)
+	return nil
+}
+
+func backupPlanObjects(r *remover, w *backup.Writer, plan *Plan) error {
+	for _, phasePlan := range plan.Phases {
+		for _, obj := range phasePlan.Objects {
+			u, err := r.dynClient.Resource(obj.GVR()).Namespace(obj.Namespace).Get(obj.Name, v1.GetOptions{})
+			if err != nil {
+				if errors.IsNotFound(err) {
+					continue
+				}
+				return fmt.Errorf("failed to backup %s [%s]: %v", obj.GVRString(), obj.displayName(), err)
+			}
+			if obj.Action == ActionStripMarks {
+				if err := w.AddMarks(phasePlan.Phase, obj.GVR(), u); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := w.AddObject(phasePlan.Phase, obj.GVR(), u); err != nil {
+				return err
+			}
+			if obj.GVR() == namespaceGVR {
+				if err := backupNamespaceContents(r, w, phasePlan.Phase, obj.Name); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func backupNamespaceContents(r *remover, w *backup.Writer, phase, namespace string) error {
+	logrus.Infof("Saving contents of namespace [%s]", namespace)
+	resources, err := getNamespacedResources(r)
+	if err != nil {
+		return err
+	}
+	for _, gvr := range resources {
+		var writeErr error
+		if err := listAll(r, gvr, namespace, func(items []unstructured.Unstructured) error {
+			for i := range items {
+				// owned objects are recreated by their owner
+				if len(items[i].GetOwnerReferences()) != 0 {
+					continue
+				}
+				if writeErr = w.AddObject(phase, gvr, &items[i]); writeErr != nil {
+					return writeErr
+				}
+			}
+			return nil
+		}); err != nil {
+			if writeErr != nil {
+				return writeErr
+			}
+			// an incomplete backup can't undo the removal
+			return fmt.Errorf("can't list [%s] in namespace [%s]: %v", gvr.Resource, namespace, err)
+		}
+	}
+	return nil
+}
+
+func getNamespacedResources(r *remover) ([]schema.GroupVersionResource, error) {
+	if r.namespacedResources != nil {
+		return r.namespacedResources, nil
+	}
+	resourceLists, err := discovery.ServerPreferredNamespacedResources(r.discClient)
+	if err != nil {
+		if !discovery.IsGroupDiscoveryFailedError(err) {
+			return nil, err
+		}
+		r.warn("Some API groups are not available for backup: %v", err)
+	}
+	resources := []schema.GroupVersionResource{}
+	for _, resourceList := range resourceLists {
+		gv, err := schema.ParseGroupVersion(resourceList.GroupVersion)
+		if err != nil {
+			return nil, err
+		}
+		for _, ar := range resourceList.APIResources {
+			if !isListable(ar) || skippedBackupResources[ar.Name] {
+				continue
+			}
+			resources = append(resources, gv.WithResource(ar.Name))
+		}
+	}
+	r.namespacedResources = resources
+	return resources, nil
+}
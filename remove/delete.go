@@ -0,0 +1,293 @@
+package remove
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	DefaultDeletionTimeout = 2 * time.Minute
+
+	deletionPollInterval = 2 * time.Second
+)
+
+// deleteFlags take a value for all phases, or a comma separated list of
+// phase=value pairs, e.g. --grace-period projects=30,clusters=60
+var deleteFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "propagation-policy",
+		Usage: "propagation policy of deletions: Orphan, Background or Foreground, for all phases or as phase=policy pairs",
+	},
+	cli.StringFlag{
+		Name:  "grace-period",
+		Usage: "grace period of deletions in seconds, for all phases or as phase=seconds pairs",
+	},
+	cli.StringFlag{
+		Name:  "wait-for-deletion",
+		Usage: "confirm deleted objects are gone before the next phase: true or false, for all phases or as phase=bool pairs (default: true)",
+	},
+	cli.StringFlag{
+		Name:  "deletion-timeout",
+		Usage: "how long to wait for deleted objects to be gone, for all phases or as phase=duration pairs (default: 2m0s)",
+	},
+}
+
+// PhaseOptions set how a phase deletes objects, unset fields keep the
+// phase defaults.
+type PhaseOptions struct {
+	PropagationPolicy  string `yaml:"propagationPolicy,omitempty"`
+	GracePeriodSeconds *int64 `yaml:"gracePeriodSeconds,omitempty"`
+	WaitForDeletion    *bool  `yaml:"waitForDeletion,omitempty"`
+	DeletionTimeout    string `yaml:"deletionTimeout,omitempty"`
+}
+
+// deleteSemantics are the resolved PhaseOptions of a phase.
+type deleteSemantics struct {
+	policy      *v1.DeletionPropagation
+	gracePeriod *int64
+	wait        bool
+	timeout     time.Duration
+}
+
+func int64Ptr(i int64) *int64 {
+	return &i
+}
+
+// management objects are orphaned so their namespaces and workloads are
+// deleted by their own phases, with the grace period Rancher used to clean up
+var defaultPhaseOptions = map[string]PhaseOptions{
+	"cluster-role-bindings": {PropagationPolicy: string(v1.DeletePropagationOrphan), GracePeriodSeconds: int64Ptr(0)},
+	"cluster-roles":         {PropagationPolicy: string(v1.DeletePropagationOrphan), GracePeriodSeconds: int64Ptr(0)},
+	"projects":              {PropagationPolicy: string(v1.DeletePropagationOrphan), GracePeriodSeconds: int64Ptr(120)},
+	"nodes":                 {PropagationPolicy: string(v1.DeletePropagationOrphan), GracePeriodSeconds: int64Ptr(120)},
+	"clusters":              {PropagationPolicy: string(v1.DeletePropagationOrphan), GracePeriodSeconds: int64Ptr(120)},
+	"users":                 {PropagationPolicy: string(v1.DeletePropagationOrphan), GracePeriodSeconds: int64Ptr(0)},
+	"namespace":             {PropagationPolicy: string(v1.DeletePropagationOrphan), GracePeriodSeconds: int64Ptr(0)},
+	"namespaces":            {PropagationPolicy: string(v1.DeletePropagationOrphan), GracePeriodSeconds: int64Ptr(0)},
+}
+
+// mergePhaseOptions sets the fields of override on base.
+func mergePhaseOptions(base, override PhaseOptions) PhaseOptions {
+	if len(override.PropagationPolicy) != 0 {
+		base.PropagationPolicy = override.PropagationPolicy
+	}
+	if override.GracePeriodSeconds != nil {
+		base.GracePeriodSeconds = override.GracePeriodSeconds
+	}
+	if override.WaitForDeletion != nil {
+		base.WaitForDeletion = override.WaitForDeletion
+	}
+	if len(override.DeletionTimeout) != 0 {
+		base.DeletionTimeout = override.DeletionTimeout
+	}
+	return base
+}
+
+// splitPhaseValues splits a delete flag into the value for all phases and
+// the values of single phases.
+func splitPhaseValues(value string, known map[string]bool) (string, map[string]string, error) {
+	all := ""
+	perPhase := map[string]string{}
+	for _, item := range splitList(value) {
+		i := strings.Index(item, "=")
+		if i < 0 {
+			all = item
+			continue
+		}
+		phase := strings.TrimSpace(item[:i])
+		if !known[phase] {
+			return "", nil, fmt.Errorf("unknown removal phase [%s]", phase)
+		}
+		perPhase[phase] = strings.TrimSpace(item[i+1:])
+	}
+	return all, perPhase, nil
+}
+
+// getFlagPhaseOptions reads the delete flags into options for all phases,
+// under the "" key, and options of single phases.
+func getFlagPhaseOptions(ctx *cli.Context, phases []phase) (map[string]PhaseOptions, error) {
+	known := map[string]bool{}
+	for _, p := range phases {
+		known[p.name] = true
+	}
+	options := map[string]PhaseOptions{}
+	set := func(flag string, f func(o *PhaseOptions, value string) error) error {
+		all, perPhase, err := splitPhaseValues(ctx.String(flag), known)
+		if err != nil {
+			return fmt.Errorf("invalid --%s: %v", flag, err)
+		}
+		if len(all) != 0 {
+			perPhase[""] = all
+		}
+		for phase, value := range perPhase {
+			o := options[phase]
+			if err := f(&o, value); err != nil {
+				return fmt.Errorf("invalid --%s: %v", flag, err)
+			}
+			options[phase] = o
+		}
+		return nil
+	}
+	if err := set("propagation-policy", func(o *PhaseOptions, value string) error {
+		o.PropagationPolicy = value
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if err := set("grace-period", func(o *PhaseOptions, value string) error {
+		gracePeriod, err := strconv.ParseInt(value, 10, 64)
+		o.GracePeriodSeconds = &gracePeriod
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	if err := set("wait-for-deletion", func(o *PhaseOptions, value string) error {
+		wait, err := strconv.ParseBool(value)
+		o.WaitForDeletion = &wait
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	if err := set("deletion-timeout", func(o *PhaseOptions, value string) error {
+		o.DeletionTimeout = value
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return options, nil
+}
+
+// resolveDeleteSemantics applies, for every phase, the profile and then the
+// flags on the phase defaults.
+func resolveDeleteSemantics(ctx *cli.Context, profile *Profile, phases []phase) (map[string]deleteSemantics, error) {
+	flagOptions, err := getFlagPhaseOptions(ctx, phases)
+	if err != nil {
+		return nil, err
+	}
+	known := map[string]bool{}
+	for _, p := range phases {
+		known[p.name] = true
+	}
+	for name := range profile.Phases {
+		if !known[name] {
+			return nil, fmt.Errorf("unknown removal phase [%s] in profile, valid phases are: %s", name, strings.Join(phaseNames(phases), ", "))
+		}
+	}
+	semantics := map[string]deleteSemantics{}
+	for _, p := range phases {
+		options := mergePhaseOptions(defaultPhaseOptions[p.name], profile.Phases[p.name])
+		options = mergePhaseOptions(options, flagOptions[""])
+		options = mergePhaseOptions(options, flagOptions[p.name])
+		s := deleteSemantics{
+			gracePeriod: options.GracePeriodSeconds,
+			wait:        options.WaitForDeletion == nil || *options.WaitForDeletion,
+			timeout:     DefaultDeletionTimeout,
+		}
+		switch v1.DeletionPropagation(options.PropagationPolicy) {
+		case "":
+		case v1.DeletePropagationOrphan, v1.DeletePropagationBackground, v1.DeletePropagationForeground:
+			policy := v1.DeletionPropagation(options.PropagationPolicy)
+			s.policy = &policy
+		default:
+			return nil, fmt.Errorf("unsupported propagation policy [%s] for phase [%s], use Orphan, Background or Foreground", options.PropagationPolicy, p.name)
+		}
+		if s.gracePeriod != nil && *s.gracePeriod < 0 {
+			return nil, fmt.Errorf("grace period of phase [%s] can't be negative", p.name)
+		}
+		if len(options.DeletionTimeout) != 0 {
+			if s.timeout, err = time.ParseDuration(options.DeletionTimeout); err != nil {
+				return nil, fmt.Errorf("invalid deletion timeout for phase [%s]: %v", p.name, err)
+			}
+		}
+		semantics[p.name] = s
+	}
+	return semantics, nil
+}
+
+// deleteOptions returns the delete options of the running phase.
+func (r *remover) deleteOptions() *v1.DeleteOptions {
+	return r.phaseDeleteOptions(r.phase)
+}
+
+// namespaceDeleteOptions returns the delete options of the namespace phase,
+// namespaces deleted along with projects or clusters don't take the grace
+// period of their owner.
+func (r *remover) namespaceDeleteOptions() *v1.DeleteOptions {
+	if r.downstream {
+		return r.phaseDeleteOptions("namespaces")
+	}
+	return r.phaseDeleteOptions("namespace")
+}
+
+func (r *remover) phaseDeleteOptions(phase string) *v1.DeleteOptions {
+	s := r.deleteSemantics[phase]
+	return &v1.DeleteOptions{
+		PropagationPolicy:  s.policy,
+		GracePeriodSeconds: s.gracePeriod,
+	}
+}
+
+// waitForDeletion confirms that the objects deleted by the running phase are
+// gone, the ones still there after the deletion timeout fail the phase.
+func waitForDeletion(r *remover, objects []PlanObject) error {
+	s := r.deleteSemantics[r.phase]
+	if !s.wait {
+		return nil
+	}
+	remaining := []PlanObject{}
+	for _, obj := range objects {
+		if obj.Action == ActionDelete {
+			remaining = append(remaining, obj)
+		}
+	}
+	if len(remaining) == 0 {
+		return nil
+	}
+	logrus.Infof("waiting for %d objects of phase [%s] to be deleted..", len(remaining), r.phase)
+	timeout := time.After(s.timeout)
+	for {
+		var mu sync.Mutex
+		existing := []PlanObject{}
+		if err := forEachParallel(r.workers, len(remaining), func(i int) error {
+			obj := remaining[i]
+			_, err := r.dynClient.Resource(obj.GVR()).Namespace(obj.Namespace).Get(obj.Name, v1.GetOptions{})
+			if errors.IsNotFound(err) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			existing = append(existing, obj)
+			return nil
+		}); err != nil {
+			return err
+		}
+		if len(existing) == 0 {
+			return nil
+		}
+		remaining = existing
+		select {
+		case <-timeout:
+			sortPlanObjects(remaining)
+			err := fmt.Errorf("not deleted after %s", s.timeout)
+			for _, obj := range remaining {
+				r.report.record(r.phase, obj, OutcomeFailed, err)
+				if journalErr := r.journal.objectFailed(r.phase, obj, err); journalErr != nil {
+					logrus.Warnf("failed to update removal journal: %v", journalErr)
+				}
+			}
+			return fmt.Errorf("%d objects are %v, e.g. %s [%s]", len(remaining), err, remaining[0].GVRString(), remaining[0].displayName())
+		case <-time.After(deletionPollInterval):
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package remove
+
+import (
+	"testing"
+)
+
+func TestNamespaceDeleteOptions(t *testing.T) {
+	semantics := map[string]deleteSemantics{
+		"projects":   {gracePeriod: int64Ptr(120)},
+		"namespace":  {gracePeriod: int64Ptr(0)},
+		"namespaces": {gracePeriod: int64Ptr(5)},
+	}
+	tests := []struct {
+		name       string
+		downstream bool
+		phase      string
+		want       int64
+	}{
+		{name: "management namespace in projects phase", phase: "projects", want: 0},
+		{name: "management namespace phase", phase: "namespace", want: 0},
+		{name: "downstream namespaces phase", downstream: true, phase: "namespaces", want: 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &remover{downstream: tt.downstream, phase: tt.phase, deleteSemantics: semantics}
+			got := r.namespaceDeleteOptions().GracePeriodSeconds
+			if got == nil || *got != tt.want {
+				t.Errorf("namespaceDeleteOptions() grace period = %v, want %d", got, tt.want)
+			}
+		})
+	}
+	r := &remover{phase: "projects", deleteSemantics: semantics}
+	if got := r.deleteOptions().GracePeriodSeconds; got == nil || *got != 120 {
+		t.Errorf("deleteOptions() grace period = %v, want 120", got)
+	}
+}
@@ -0,0 +1,179 @@
+package remove
+
+import (
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+)
+
+// number of objects fetched per list request
+const listPageSize = 500
+
+type apiGroupResources struct {
+	group     v1.APIGroup
+	resources []v1.APIResource
+}
+
+// getAPIGroupResources discovers the API groups served by the cluster and
+// their resources, the result is cached for the rest of the removal. Groups
+// that fail discovery are skipped with a warning.
+func getAPIGroupResources(r *remover) ([]apiGroupResources, error) {
+	if r.apiResources != nil {
+		return r.apiResources, nil
+	}
+	apiGroupsList, err := r.discClient.ServerGroups()
+	if err != nil {
+		return nil, err
+	}
+	apiResources := []apiGroupResources{}
+	resourceIndex := map[schema.GroupVersionResource]v1.APIResource{}
+	for _, apiGroup := range apiGroupsList.Groups {
+		groupAPIResources, err := getGroupAPIResourceList(r.discClient, apiGroup)
+		if err != nil {
+			// an aggregated API being down shouldn't stop the removal
+			r.warn("Skipping API group [%s], discovery failed: %v", apiGroup.PreferredVersion.GroupVersion, err)
+			continue
+		}
+		for _, ar := range groupAPIResources {
+			gvr, err := getGroupVersionResource(apiGroup, ar)
+			if err != nil {
+				return nil, err
+			}
+			resourceIndex[gvr] = ar
+		}
+		apiResources = append(apiResources, apiGroupResources{
+			group:     apiGroup,
+			resources: groupAPIResources,
+		})
+	}
+	r.apiResources = apiResources
+	r.resourceIndex = resourceIndex
+	return apiResources, nil
+}
+
+// getPreferredGVR looks up a resource in the preferred version of its group
+// served by the cluster, ok is false when the cluster doesn't serve it.
+func getPreferredGVR(r *remover, group, resource string) (gvr schema.GroupVersionResource, ok bool, err error) {
+	apiResources, err := getAPIGroupResources(r)
+	if err != nil {
+		return gvr, false, err
+	}
+	for _, groupResources := range apiResources {
+		if groupResources.group.Name != group {
+			continue
+		}
+		for _, ar := range groupResources.resources {
+			if ar.Name == resource {
+				gvr, err = getGroupVersionResource(groupResources.group, ar)
+				return gvr, err == nil, err
+			}
+		}
+	}
+	return gvr, false, nil
+}
+
+// findObjects lists a resource in its preferred version across all namespaces
+// and returns the objects matching match, nothing when the cluster doesn't serve it.
+func findObjects(r *remover, group, resource, action string, match func(obj unstructured.Unstructured) bool) ([]PlanObject, error) {
+	objects := []PlanObject{}
+	gvr, ok, err := getPreferredGVR(r, group, resource)
+	if err != nil || !ok {
+		return objects, err
+	}
+	err = listAll(r, gvr, "", func(items []unstructured.Unstructured) error {
+		for _, item := range items {
+			if match(item) {
+				objects = append(objects, newPlanObject(gvr, item.GetNamespace(), item.GetName(), action))
+			}
+		}
+		return nil
+	})
+	return objects, err
+}
+
+func getGroupAPIResourceList(dc discovery.DiscoveryInterface, apiGroup v1.APIGroup) ([]v1.APIResource, error) {
+	srl, err := dc.ServerResourcesForGroupVersion(apiGroup.PreferredVersion.GroupVersion)
+	if err != nil {
+		return nil, err
+	}
+	return srl.APIResources, nil
+}
+
+// getGroupVersionResource fills in the group and version of a discovered
+// resource, discovery leaves them empty when they match the listed group version.
+func getGroupVersionResource(apiGroup v1.APIGroup, ar v1.APIResource) (schema.GroupVersionResource, error) {
+	gv, err := schema.ParseGroupVersion(apiGroup.PreferredVersion.GroupVersion)
+	if err != nil {
+		return schema.GroupVersionResource{}, err
+	}
+	gvr := gv.WithResource(ar.Name)
+	if len(ar.Group) != 0 {
+		gvr.Group = ar.Group
+	}
+	if len(ar.Version) != 0 {
+		gvr.Version = ar.Version
+	}
+	return gvr, nil
+}
+
+func hasVerb(ar v1.APIResource, verb string) bool {
+	for _, v := range ar.Verbs {
+		if v == verb {
+			return true
+		}
+	}
+	return false
+}
+
+func isUpdateble(ar v1.APIResource) bool {
+	if strings.Contains(ar.Name, "/") {
+		return false
+	}
+	return hasVerb(ar, "update")
+}
+
+func isPatchable(ar v1.APIResource) bool {
+	if strings.Contains(ar.Name, "/") {
+		return false
+	}
+	return hasVerb(ar, "patch")
+}
+
+// supportsVerb looks up a discovered resource, or one of its subresources
+// when subresource isn't empty, and tells whether it accepts verb.
+func (r *remover) supportsVerb(gvr schema.GroupVersionResource, subresource, verb string) bool {
+	if len(subresource) != 0 {
+		gvr.Resource = gvr.Resource + "/" + subresource
+	}
+	ar, ok := r.resourceIndex[gvr]
+	return ok && hasVerb(ar, verb)
+}
+
+func isListable(ar v1.APIResource) bool {
+	if strings.Contains(ar.Name, "/") {
+		return false
+	}
+	return hasVerb(ar, "list")
+}
+
+// listAll lists a resource page by page and hands every page to f, an empty
+// namespace lists the resource across all namespaces.
+func listAll(r *remover, gvr schema.GroupVersionResource, namespace string, f func(items []unstructured.Unstructured) error) error {
+	opts := v1.ListOptions{Limit: listPageSize}
+	for {
+		list, err := r.dynClient.Resource(gvr).Namespace(namespace).List(opts)
+		if err != nil {
+			return err
+		}
+		if err := f(list.Items); err != nil {
+			return err
+		}
+		if len(list.GetContinue()) == 0 {
+			return nil
+		}
+		opts.Continue = list.GetContinue()
+	}
+}
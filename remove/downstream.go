@@ -0,0 +1,157 @@
+package remove
+
+import (
+	"github.com/rancher/system-tools/utils"
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// API groups of the Rancher agents on downstream clusters. Other cattle.io
+// groups, such as helm.cattle.io and k3s.cattle.io, belong to the RKE2 and
+// k3s deployments of CNI, CoreDNS and ingress and are left alone.
+var rancherAgentGroups = map[string]bool{
+	"management.cattle.io": true,
+	"project.cattle.io":    true,
+	"cluster.cattle.io":    true,
+	"fleet.cattle.io":      true,
+	"catalog.cattle.io":    true,
+	"ui.cattle.io":         true,
+}
+
+// namespaces of the Rancher agents on downstream clusters, along with --namespace
+var rancherAgentNamespaces = []string{
+	"cattle-fleet-system",
+	"fleet-system",
+	"cattle-impersonation-system",
+}
+
+// namespaces Rancher creates on downstream clusters for the features it
+// deploys, removed along with the agent namespaces
+var rancherFeatureNamespaces = []string{
+	"cattle-prometheus",
+	"cattle-logging",
+	"cattle-monitoring-system",
+	"cattle-logging-system",
+	"cattle-dashboards",
+	"cattle-gatekeeper-system",
+	"cattle-istio",
+	"cattle-istio-system",
+	"cattle-cis-system",
+}
+
+// marks the RKE2 and k3s manifest and Helm controllers put on the objects they
+// deploy, kept on downstream clusters
+var distributionKeyPatterns = []string{
+	"objectset.rio.cattle.io/*",
+	"helm.cattle.io/*",
+	"k3s.cattle.io/*",
+}
+
+var daemonSetGVR = schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "daemonsets"}
+
+// downstreamPhases clean the Rancher agents and everything they created off a
+// downstream cluster, the workloads of the cluster are left in place.
+var downstreamPhases = []phase{
+	{name: "webhooks", discover: getRancherWebhooksAndAPIServices, run: removeRancherWebhooks},
+	{name: "agents", discover: getCattleAgents, run: removeCattleAgents},
+	{name: "helm-releases", discover: getHelmReleaseObjects, run: removeHelmReleases},
+	{name: "cluster-role-bindings", discover: getCattleClusterRoleBindings, run: clusterRoleBindginsCleanup},
+	{name: "cluster-roles", discover: getCattleClusterRoles, run: clusterRolesCleanup},
+	{name: "cattle-marks", discover: getCattleMarkedResources, run: removeCattleAnnotationsFinalizersLabels},
+	{name: "cattle-resources", discover: getCattleAPIGroupResources, run: removeCattleAPIGroupResources},
+	{name: "crds", discover: getCattleCRDs, run: removeCattleCRDs},
+	{name: "namespaces", discover: getCattleNamespaces, run: cattleNamespacesCleanup},
+}
+
+// getCattleAgents finds the cattle-cluster-agent deployment and the
+// cattle-node-agent daemonset, along with any other workload in the Rancher
+// agent namespaces.
+func getCattleAgents(r *remover) ([]PlanObject, error) {
+	existing, err := getNamespacesSet(r.k8sClient)
+	if err != nil {
+		return nil, err
+	}
+	objects := []PlanObject{}
+	for _, namespace := range append([]string{r.namespace}, rancherAgentNamespaces...) {
+		if !existing[namespace] {
+			continue
+		}
+		deployments, err := r.k8sClient.AppsV1().Deployments(namespace).List(v1.ListOptions{})
+		if err != nil {
+			return nil, err
+		}
+		for _, deployment := range deployments.Items {
+			objects = append(objects, newPlanObject(deploymentGVR, deployment.Namespace, deployment.Name, ActionDelete))
+		}
+		daemonSets, err := r.k8sClient.AppsV1().DaemonSets(namespace).List(v1.ListOptions{})
+		if err != nil {
+			return nil, err
+		}
+		for _, daemonSet := range daemonSets.Items {
+			objects = append(objects, newPlanObject(daemonSetGVR, daemonSet.Namespace, daemonSet.Name, ActionDelete))
+		}
+	}
+	return objects, nil
+}
+
+func removeCattleAgents(r *remover, objects []PlanObject) error {
+	logrus.Infof("Removing Cattle agents")
+	for _, obj := range objects {
+		logrus.Infof("deleting %s [%s]..", obj.Resource, obj.displayName())
+		if err := r.process(obj, func() error {
+			return deleteObject(r, obj)
+		}); err != nil {
+			return err
+		}
+	}
+	logrus.Infof("Removed Cattle agents successfully")
+	return nil
+}
+
+// isRancherGroup matches the API groups whose resources and CRDs are removed,
+// every cattle.io group on the management plane and only the Rancher agent
+// groups on downstream clusters.
+func isRancherGroup(r *remover, group string) bool {
+	if r.downstream {
+		return rancherAgentGroups[group]
+	}
+	return utils.IsCattleDomain(group)
+}
+
+func isCattleNamespace(r *remover, name string) bool {
+	for _, namespace := range append(append([]string{}, rancherAgentNamespaces...), rancherFeatureNamespaces...) {
+		if name == namespace {
+			return true
+		}
+	}
+	return name == r.namespace
+}
+
+func getCattleNamespaces(r *remover) ([]PlanObject, error) {
+	namespaces, err := getNamespacesList(r.k8sClient)
+	if err != nil {
+		return nil, err
+	}
+	objects := []PlanObject{}
+	for _, name := range namespaces {
+		if isCattleNamespace(r, name) {
+			objects = append(objects, newPlanObject(namespaceGVR, "", name, ActionDelete))
+		}
+	}
+	return objects, nil
+}
+
+func cattleNamespacesCleanup(r *remover, objects []PlanObject) error {
+	logrus.Infof("Removing Cattle namespaces")
+	for _, obj := range objects {
+		logrus.Infof("deleting namespace [%s]..", obj.Name)
+		if err := r.process(obj, func() error {
+			return deleteNamespaceAndWait(r, obj.Name)
+		}); err != nil {
+			return err
+		}
+	}
+	logrus.Infof("Successfully removed Cattle namespaces")
+	return nil
+}
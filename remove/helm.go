@@ -0,0 +1,243 @@
+package remove
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	yamlutil "k8s.io/apimachinery/pkg/util/yaml"
+)
+
+const (
+	helmReleaseSecretType = "helm.sh/release.v1"
+	helmReleaseSelector   = "owner=helm"
+)
+
+var secretGVR = schema.GroupVersionResource{Version: "v1", Resource: "secrets"}
+
+// charts of the Rancher installation and its companion charts
+var rancherHelmCharts = map[string]bool{
+	"rancher":              true,
+	"rancher-webhook":      true,
+	"fleet":                true,
+	"fleet-crd":            true,
+	"fleet-agent":          true,
+	"rancher-operator":     true,
+	"rancher-operator-crd": true,
+}
+
+// namespaces the Rancher companion charts install to, along with --namespace
+var rancherNamespaces = []string{
+	"cattle-fleet-system",
+	"cattle-fleet-local-system",
+	"cattle-fleet-clusters-system",
+	"fleet-local",
+	"fleet-default",
+	"fleet-system",
+	"rancher-operator-system",
+	"cattle-global-data",
+	"cattle-global-nt",
+	"cattle-impersonation-system",
+}
+
+// kinds of release objects left to the crds and namespace phases
+var helmReleaseSkippedKinds = map[string]bool{
+	"CustomResourceDefinition": true,
+	"Namespace":                true,
+}
+
+// helmRelease holds the fields of a Helm v3 release record the removal needs.
+type helmRelease struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+	Version   int    `json:"version"`
+	Manifest  string `json:"manifest"`
+	Chart     struct {
+		Metadata struct {
+			Name string `json:"name"`
+		} `json:"metadata"`
+	} `json:"chart"`
+}
+
+// decodeHelmRelease decodes the release record of a Helm v3 release secret,
+// a base64 encoded and usually gzipped JSON document.
+func decodeHelmRelease(secret *corev1.Secret) (*helmRelease, error) {
+	data, err := base64.StdEncoding.DecodeString(string(secret.Data["release"]))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(data, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		if data, err = ioutil.ReadAll(gz); err != nil {
+			return nil, err
+		}
+	}
+	release := &helmRelease{}
+	if err := json.Unmarshal(data, release); err != nil {
+		return nil, err
+	}
+	return release, nil
+}
+
+// getRancherHelmReleases returns the latest revision of every Rancher release
+// and the secrets of all of its revisions.
+func getRancherHelmReleases(r *remover) (map[string]*helmRelease, map[string][]PlanObject, error) {
+	secrets, err := r.k8sClient.CoreV1().Secrets("").List(v1.ListOptions{LabelSelector: helmReleaseSelector})
+	if err != nil {
+		return nil, nil, err
+	}
+	releases := map[string]*helmRelease{}
+	releaseSecrets := map[string][]PlanObject{}
+	for i := range secrets.Items {
+		secret := &secrets.Items[i]
+		if secret.Type != helmReleaseSecretType {
+			continue
+		}
+		release, err := decodeHelmRelease(secret)
+		if err != nil {
+			r.warn("Can't decode Helm release secret [%s/%s]: %v", secret.Namespace, secret.Name, err)
+			continue
+		}
+		if !rancherHelmCharts[release.Chart.Metadata.Name] {
+			continue
+		}
+		key := secret.Namespace + "/" + release.Name
+		releaseSecrets[key] = append(releaseSecrets[key], newPlanObject(secretGVR, secret.Namespace, secret.Name, ActionDelete))
+		if latest, ok := releases[key]; !ok || release.Version > latest.Version {
+			releases[key] = release
+		}
+	}
+	return releases, releaseSecrets, nil
+}
+
+// getReleaseObjects lists the objects of a release manifest that still exist.
+func getReleaseObjects(r *remover, release *helmRelease) ([]PlanObject, error) {
+	if _, err := getAPIGroupResources(r); err != nil {
+		return nil, err
+	}
+	objects := []PlanObject{}
+	decoder := yamlutil.NewYAMLOrJSONDecoder(bytes.NewReader([]byte(release.Manifest)), 4096)
+	for {
+		manifest := map[string]interface{}{}
+		if err := decoder.Decode(&manifest); err != nil {
+			if err == io.EOF {
+				return objects, nil
+			}
+			return nil, fmt.Errorf("failed to read manifest of Helm release [%s/%s]: %v", release.Namespace, release.Name, err)
+		}
+		apiVersion, _ := manifest["apiVersion"].(string)
+		kind, _ := manifest["kind"].(string)
+		metadata, _ := manifest["metadata"].(map[string]interface{})
+		name, _ := metadata["name"].(string)
+		if len(kind) == 0 || len(name) == 0 || helmReleaseSkippedKinds[kind] {
+			continue
+		}
+		gv, err := schema.ParseGroupVersion(apiVersion)
+		if err != nil {
+			return nil, err
+		}
+		gvr, namespaced, ok := r.findResourceForKind(gv.Group, kind)
+		if !ok {
+			logrus.Debugf("kind [%s] of Helm release [%s/%s] is not served by the cluster", kind, release.Namespace, release.Name)
+			continue
+		}
+		namespace := ""
+		if namespaced {
+			namespace, _ = metadata["namespace"].(string)
+			if len(namespace) == 0 {
+				namespace = release.Namespace
+			}
+		}
+		if _, err := r.dynClient.Resource(gvr).Namespace(namespace).Get(name, v1.GetOptions{}); err != nil {
+			if errors.IsNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+		objects = append(objects, newPlanObject(gvr, namespace, name, ActionDelete))
+	}
+}
+
+// findResourceForKind looks up the discovered resource serving a kind of a group.
+func (r *remover) findResourceForKind(group, kind string) (schema.GroupVersionResource, bool, bool) {
+	for gvr, ar := range r.resourceIndex {
+		if gvr.Group == group && ar.Kind == kind && !strings.Contains(gvr.Resource, "/") {
+			return gvr, ar.Namespaced, true
+		}
+	}
+	return schema.GroupVersionResource{}, false, false
+}
+
+// getHelmReleaseObjects finds the objects of the Rancher Helm releases,
+// followed by the release secrets recording them.
+func getHelmReleaseObjects(r *remover) ([]PlanObject, error) {
+	releases, releaseSecrets, err := getRancherHelmReleases(r)
+	if err != nil {
+		return nil, err
+	}
+	objects := []PlanObject{}
+	secrets := []PlanObject{}
+	keys := []string{}
+	for key := range releases {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		release := releases[key]
+		logrus.Infof("Found Helm release [%s] of chart [%s] revision [%d]", key, release.Chart.Metadata.Name, release.Version)
+		releaseObjects, err := getReleaseObjects(r, release)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, releaseObjects...)
+		secrets = append(secrets, releaseSecrets[key]...)
+	}
+	sortPlanObjects(objects)
+	sortPlanObjects(secrets)
+	return append(objects, secrets...), nil
+}
+
+func removeHelmReleases(r *remover, objects []PlanObject) error {
+	logrus.Infof("Removing Rancher Helm releases")
+	for _, obj := range objects {
+		logrus.Infof("deleting %s [%s]..", obj.Resource, obj.displayName())
+		if err := r.process(obj, func() error {
+			return deleteObject(r, obj)
+		}); err != nil {
+			return err
+		}
+	}
+	logrus.Infof("Successfully removed Rancher Helm releases")
+	return nil
+}
+
+// getRancherNamespaceNames returns --namespace and the Rancher companion
+// namespaces that exist.
+func getRancherNamespaceNames(r *remover) ([]string, error) {
+	existing, err := getNamespacesSet(r.k8sClient)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, name := range append([]string{r.namespace}, rancherNamespaces...) {
+		if existing[name] {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
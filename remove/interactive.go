@@ -0,0 +1,126 @@
+package remove
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	DecisionContinue = "continue"
+	DecisionSkip     = "skip"
+	DecisionList     = "list"
+	DecisionAbort    = "abort"
+
+	// namespaces named in a phase summary before the rest are counted
+	summaryNamespaces = 10
+)
+
+var errRemovalAborted = fmt.Errorf("removal aborted by the operator")
+
+type PhaseDecision struct {
+	Phase    string    `json:"phase"`
+	Decision string    `json:"decision"`
+	Summary  string    `json:"summary"`
+	Time     time.Time `json:"time"`
+}
+
+// summarizePhase describes the objects of a phase per action and resource,
+// e.g. "delete 4 projects, 3 namespaces with namespaces c-xxxx, p-xxxx".
+func summarizePhase(objects []PlanObject) string {
+	if len(objects) == 0 {
+		return "nothing to do"
+	}
+	counts := map[string]map[string]int{}
+	namespaces := []string{}
+	for _, obj := range objects {
+		if counts[obj.Action] == nil {
+			counts[obj.Action] = map[string]int{}
+		}
+		counts[obj.Action][obj.Resource]++
+		if obj.GVR() == namespaceGVR {
+			namespaces = append(namespaces, obj.Name)
+		}
+	}
+	actions := []string{}
+	for action, resources := range counts {
+		names := []string{}
+		for resource := range resources {
+			names = append(names, resource)
+		}
+		sort.Strings(names)
+		parts := []string{}
+		for _, resource := range names {
+			parts = append(parts, fmt.Sprintf("%d %s", resources[resource], resource))
+		}
+		verb := "delete"
+		if action == ActionStripMarks {
+			verb = "strip Rancher marks from"
+		}
+		actions = append(actions, fmt.Sprintf("%s %s", verb, strings.Join(parts, ", ")))
+	}
+	sort.Strings(actions)
+	summary := strings.Join(actions, "; ")
+	if len(namespaces) != 0 {
+		sort.Strings(namespaces)
+		named := namespaces
+		if len(named) > summaryNamespaces {
+			named = named[:summaryNamespaces]
+		}
+		summary += " with namespaces " + strings.Join(named, ", ")
+		if more := len(namespaces) - len(named); more != 0 {
+			summary += fmt.Sprintf(" and %d more", more)
+		}
+	}
+	return summary
+}
+
+func parseDecision(input string) string {
+	switch strings.ToLower(strings.TrimSpace(input)) {
+	case "c", DecisionContinue:
+		return DecisionContinue
+	case "s", DecisionSkip:
+		return DecisionSkip
+	case "l", DecisionList:
+		return DecisionList
+	case "a", DecisionAbort:
+		return DecisionAbort
+	}
+	return ""
+}
+
+// confirmPhase shows the summary of a phase and asks the operator what to do
+// with it until they continue, skip it or abort, every answer is reported.
+func confirmPhase(r *remover, phase string, objects []PlanObject) (string, error) {
+	summary := summarizePhase(objects)
+	for {
+		fmt.Printf("\nPhase [%s]: %s\n", phase, summary)
+		fmt.Printf("[c]ontinue, [s]kip, [l]ist objects or [a]bort: ")
+		input, err := r.stdin.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		decision := parseDecision(input)
+		if len(decision) == 0 {
+			fmt.Printf("unknown choice [%s]\n", strings.TrimSpace(input))
+			continue
+		}
+		r.report.recordDecision(phase, decision, summary)
+		if decision != DecisionList {
+			logrus.Infof("Operator chose to %s phase [%s]", decision, phase)
+			return decision, nil
+		}
+		printPlanTable(os.Stdout, &Plan{
+			Namespace: r.namespace,
+			Phases: []PhasePlan{{
+				Phase:   phase,
+				Counts:  countByGVR(objects),
+				Objects: objects,
+			}},
+		})
+	}
+}
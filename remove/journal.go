@@ -0,0 +1,302 @@
+package remove
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	journalFilePrefix = "rancher-removal-journal"
+
+	PhasePending   = "pending"
+	PhaseRunning   = "running"
+	PhaseCompleted = "completed"
+	PhaseSkipped   = "skipped"
+
+	// the journal is saved every journalSaveInterval processed objects
+	// and at the end of every phase
+	journalSaveInterval = 50
+)
+
+type JournalPhase struct {
+	Name      string            `json:"name"`
+	Status    string            `json:"status"`
+	Objects   []PlanObject      `json:"objects,omitempty"`
+	Processed map[string]bool   `json:"processed,omitempty"`
+	Failed    map[string]string `json:"failed,omitempty"`
+}
+
+// Journal records the progress of a removal on disk, so an interrupted or
+// failed removal can be resumed without repeating finished work.
+type Journal struct {
+	Namespace  string          `json:"namespace"`
+	Downstream bool            `json:"downstream,omitempty"`
+	BackupFile string          `json:"backupFile,omitempty"`
+	StartedAt  time.Time       `json:"startedAt"`
+	UpdatedAt  time.Time       `json:"updatedAt"`
+	Phases     []*JournalPhase `json:"phases"`
+	Warnings   []string        `json:"warnings,omitempty"`
+
+	path    string
+	mu      sync.Mutex
+	unsaved int
+}
+
+func newJournal(path, namespace string, downstream bool, phases []phase) *Journal {
+	j := &Journal{
+		Namespace:  namespace,
+		Downstream: downstream,
+		StartedAt:  time.Now().UTC(),
+		Phases:     []*JournalPhase{},
+		path:       path,
+	}
+	for _, p := range phases {
+		j.Phases = append(j.Phases, &JournalPhase{
+			Name:      p.name,
+			Status:    PhasePending,
+			Processed: map[string]bool{},
+			Failed:    map[string]string{},
+		})
+	}
+	return j
+}
+
+// getJournalPath returns the --journal file, by default a file per cluster and
+// removal mode, the cluster being told apart by the UID of kube-system.
+func getJournalPath(path string, k8sClient kubernetes.Interface, downstream bool) (string, error) {
+	if len(path) != 0 {
+		return path, nil
+	}
+	kubeSystem, err := k8sClient.CoreV1().Namespaces().Get("kube-system", v1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("failed to identify the cluster for the removal journal, set --journal: %v", err)
+	}
+	mode := "management"
+	if downstream {
+		mode = "downstream"
+	}
+	return fmt.Sprintf("%s-%s-%s.json", journalFilePrefix, mode, kubeSystem.UID), nil
+}
+
+// openJournal starts a new journal, or loads the existing one when resuming.
+func openJournal(path, namespace string, downstream bool, phases []phase, resume bool) (*Journal, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		if resume {
+			return nil, fmt.Errorf("can't resume removal, journal [%s] doesn't exist", path)
+		}
+		return newJournal(path, namespace, downstream, phases), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !resume {
+		return nil, fmt.Errorf("journal [%s] of a previous removal exists, use --resume to continue it or delete the file to start over", path)
+	}
+	j := newJournal(path, namespace, downstream, phases)
+	saved := &Journal{}
+	if err := json.Unmarshal(data, saved); err != nil {
+		return nil, fmt.Errorf("failed to read journal [%s]: %v", path, err)
+	}
+	if saved.Namespace != namespace {
+		return nil, fmt.Errorf("journal [%s] is for a removal in namespace [%s], not [%s]", path, saved.Namespace, namespace)
+	}
+	if saved.Downstream != downstream {
+		return nil, fmt.Errorf("journal [%s] is for a removal with --downstream=%t", path, saved.Downstream)
+	}
+	j.BackupFile = saved.BackupFile
+	j.StartedAt = saved.StartedAt
+	for _, savedPhase := range saved.Phases {
+		jp := j.phase(savedPhase.Name)
+		if jp == nil {
+			continue
+		}
+		jp.Status = savedPhase.Status
+		jp.Objects = savedPhase.Objects
+		if savedPhase.Processed != nil {
+			jp.Processed = savedPhase.Processed
+		}
+		if savedPhase.Failed != nil {
+			jp.Failed = savedPhase.Failed
+		}
+	}
+	return j, nil
+}
+
+func (j *Journal) phase(name string) *JournalPhase {
+	for _, jp := range j.Phases {
+		if jp.Name == name {
+			return jp
+		}
+	}
+	return nil
+}
+
+func (j *Journal) setBackupFile(fileName string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.BackupFile = fileName
+	return j.saveLocked()
+}
+
+// startPhase records the discovered objects of a phase and returns the ones
+// that still need to be processed.
+func (j *Journal) startPhase(name string, objects []PlanObject) ([]PlanObject, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	jp := j.phase(name)
+	jp.Status = PhaseRunning
+	jp.Objects = objects
+	pending := []PlanObject{}
+	for _, obj := range objects {
+		if !jp.Processed[obj.key()] {
+			pending = append(pending, obj)
+		}
+	}
+	return pending, j.saveLocked()
+}
+
+func (j *Journal) completePhase(name string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.phase(name).Status = PhaseCompleted
+	return j.saveLocked()
+}
+
+func (j *Journal) skipPhase(name string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.phase(name).Status = PhaseSkipped
+	return j.saveLocked()
+}
+
+func (j *Journal) objectProcessed(phase string, obj PlanObject) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	jp := j.phase(phase)
+	jp.Processed[obj.key()] = true
+	delete(jp.Failed, obj.key())
+	j.unsaved++
+	if j.unsaved < journalSaveInterval {
+		return nil
+	}
+	return j.saveLocked()
+}
+
+func (j *Journal) objectFailed(phase string, obj PlanObject, err error) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	jp := j.phase(phase)
+	jp.Failed[obj.key()] = err.Error()
+	delete(jp.Processed, obj.key())
+	return j.saveLocked()
+}
+
+func (j *Journal) addWarning(msg string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.Warnings = append(j.Warnings, msg)
+	return j.saveLocked()
+}
+
+// finish moves the journal aside once every phase is completed or skipped,
+// so the next removal starts a new one. It returns the path of the finished
+// journal, empty when some phase is left.
+func (j *Journal) finish() (string, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for _, jp := range j.Phases {
+		if jp.Status != PhaseCompleted && jp.Status != PhaseSkipped {
+			return "", nil
+		}
+	}
+	if err := j.saveLocked(); err != nil {
+		return "", err
+	}
+	finished := strings.TrimSuffix(j.path, ".json") + "-completed.json"
+	return finished, os.Rename(j.path, finished)
+}
+
+func (j *Journal) save() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.saveLocked()
+}
+
+func (j *Journal) saveLocked() error {
+	j.UpdatedAt = time.Now().UTC()
+	data, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return err
+	}
+	// write and rename so an interrupted save never leaves a broken journal
+	tmpPath := j.path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, j.path); err != nil {
+		return err
+	}
+	j.unsaved = 0
+	return nil
+}
+
+// printReport lists the warnings and, per phase, the objects that failed and
+// the objects that were discovered but never processed.
+func (j *Journal) printReport(w io.Writer) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "Removal report for namespace [%s], journal [%s]\n\n", j.Namespace, j.path)
+	fmt.Fprintf(tw, "PHASE\tSTATUS\tOBJECTS\tPROCESSED\tFAILED\tNOT PROCESSED\n")
+	for _, jp := range j.Phases {
+		failed, unprocessed := jp.outstanding()
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%d\t%d\n", jp.Name, jp.Status, len(jp.Objects), len(jp.Objects)-len(failed)-len(unprocessed), len(failed), len(unprocessed))
+	}
+	if len(j.Warnings) != 0 {
+		fmt.Fprintf(tw, "\nWarnings:\n")
+		for _, w := range j.Warnings {
+			fmt.Fprintf(tw, "  %s\n", w)
+		}
+	}
+	for _, jp := range j.Phases {
+		failed, unprocessed := jp.outstanding()
+		if len(failed) != 0 {
+			fmt.Fprintf(tw, "\nFailed objects in phase [%s]:\n", jp.Name)
+			for _, obj := range failed {
+				fmt.Fprintf(tw, "  %s\t%s\t%s\n", obj.GVRString(), obj.displayName(), jp.Failed[obj.key()])
+			}
+		}
+		if len(unprocessed) != 0 {
+			fmt.Fprintf(tw, "\nObjects never processed in phase [%s]:\n", jp.Name)
+			for _, obj := range unprocessed {
+				fmt.Fprintf(tw, "  %s\t%s\n", obj.GVRString(), obj.displayName())
+			}
+		}
+	}
+	return tw.Flush()
+}
+
+func (jp *JournalPhase) outstanding() (failed, unprocessed []PlanObject) {
+	for _, obj := range jp.Objects {
+		if jp.Processed[obj.key()] {
+			continue
+		}
+		if _, ok := jp.Failed[obj.key()]; ok {
+			failed = append(failed, obj)
+			continue
+		}
+		unprocessed = append(unprocessed, obj)
+	}
+	return
+}
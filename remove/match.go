@@ -0,0 +1,144 @@
+package remove
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/rancher/system-tools/utils"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// label Rancher uses to find the RBAC objects it created, it doesn't make an object Rancher owned
+const cattleCreatorLabel = "cattle.io/creator"
+
+// prefixes of the finalizers set by Rancher controllers
+var cattleFinalizerPrefixes = []string{
+	"controller.cattle.io",
+	"clusterscoped.controller.cattle.io",
+	"wrangler.cattle.io",
+}
+
+// ownershipMatcher decides which labels, annotations and finalizers belong to
+// Rancher. keep and strip are path.Match patterns on the full key supplied by
+// the user, keep wins over strip.
+type ownershipMatcher struct {
+	keep  []string
+	strip []string
+	// keys kept unless the user lists decide otherwise
+	builtinKeep []string
+}
+
+func newOwnershipMatcher(keep, strip []string) (*ownershipMatcher, error) {
+	for _, pattern := range append(append([]string{}, keep...), strip...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid key pattern [%s]: %v", pattern, err)
+		}
+	}
+	return &ownershipMatcher{
+		keep:  keep,
+		strip: strip,
+	}, nil
+}
+
+// splitKey splits a qualified key into its prefix and name, keys without a
+// prefix return an empty prefix.
+func splitKey(key string) (string, string) {
+	i := strings.Index(key, "/")
+	if i < 0 {
+		return "", key
+	}
+	return key[:i], key[i+1:]
+}
+
+func matchesAny(patterns []string, key string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, key); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// userDecision returns whether the user lists decide for the key.
+func (m *ownershipMatcher) userDecision(key string) (strip bool, decided bool) {
+	if matchesAny(m.keep, key) {
+		return false, true
+	}
+	if matchesAny(m.strip, key) {
+		return true, true
+	}
+	return false, false
+}
+
+func (m *ownershipMatcher) isCattleKey(key string) bool {
+	if strip, decided := m.userDecision(key); decided {
+		return strip
+	}
+	if matchesAny(m.builtinKeep, key) {
+		return false
+	}
+	prefix, _ := splitKey(key)
+	return utils.IsCattleDomain(prefix)
+}
+
+func (m *ownershipMatcher) isCattleFinalizer(finalizer string) bool {
+	if strip, decided := m.userDecision(finalizer); decided {
+		return strip
+	}
+	if matchesAny(m.builtinKeep, finalizer) {
+		return false
+	}
+	prefix, _ := splitKey(finalizer)
+	for _, cattlePrefix := range cattleFinalizerPrefixes {
+		if prefix == cattlePrefix {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *ownershipMatcher) cleanupFinalizers(finalizers []string) []string {
+	updatedFinalizers := []string{}
+	for _, f := range finalizers {
+		if m.isCattleFinalizer(f) {
+			continue
+		}
+		updatedFinalizers = append(updatedFinalizers, f)
+	}
+	return updatedFinalizers
+}
+
+func (m *ownershipMatcher) cleanupAnnotationsLabels(labels map[string]string) map[string]string {
+	for k := range labels {
+		if m.isCattleKey(k) {
+			delete(labels, k)
+		}
+	}
+	return labels
+}
+
+func (m *ownershipMatcher) hasCattleMark(resource unstructured.Unstructured) bool {
+	for _, s := range resource.GetFinalizers() {
+		if m.isCattleFinalizer(s) {
+			return true
+		}
+	}
+	for k := range resource.GetLabels() {
+		if k != cattleCreatorLabel && m.isCattleKey(k) {
+			return true
+		}
+	}
+	for k := range resource.GetAnnotations() {
+		if m.isCattleKey(k) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *ownershipMatcher) removeCattleMark(resource *unstructured.Unstructured) {
+	resource.SetFinalizers(m.cleanupFinalizers(resource.GetFinalizers()))
+	resource.SetLabels(m.cleanupAnnotationsLabels(resource.GetLabels()))
+	resource.SetAnnotations(m.cleanupAnnotationsLabels(resource.GetAnnotations()))
+}
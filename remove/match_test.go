@@ -0,0 +1,134 @@
+package remove
+
+import (
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestIsCattleKey(t *testing.T) {
+	tests := []struct {
+		name        string
+		keep, strip []string
+		downstream  bool
+		key         string
+		want        bool
+	}{
+		{name: "cattle domain", key: "cattle.io/timestamp", want: true},
+		{name: "cattle subdomain", key: "field.cattle.io/projectId", want: true},
+		{name: "lookalike domain", key: "notcattle.io/foo", want: false},
+		{name: "cattle in the name", key: "example.com/cattle.io", want: false},
+		{name: "unprefixed key", key: "cattle.io", want: false},
+		{name: "third party", key: "app.kubernetes.io/name", want: false},
+		{name: "kept", keep: []string{"example.cattle.io/*"}, key: "example.cattle.io/owner", want: false},
+		{name: "keep wins over strip", keep: []string{"field.cattle.io/*"}, strip: []string{"field.cattle.io/*"}, key: "field.cattle.io/projectId", want: false},
+		{name: "stripped", strip: []string{"example.com/*"}, key: "example.com/owner", want: true},
+		{name: "distribution key on the management plane", key: "objectset.rio.cattle.io/hash", want: true},
+		{name: "distribution key downstream", downstream: true, key: "objectset.rio.cattle.io/hash", want: false},
+		{name: "helm key downstream", downstream: true, key: "helm.cattle.io/chart-url", want: false},
+		{name: "rancher key downstream", downstream: true, key: "field.cattle.io/projectId", want: true},
+		{name: "distribution key stripped downstream", downstream: true, strip: []string{"objectset.rio.cattle.io/*"}, key: "objectset.rio.cattle.io/hash", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := newOwnershipMatcher(tt.keep, tt.strip)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.downstream {
+				m.builtinKeep = distributionKeyPatterns
+			}
+			if got := m.isCattleKey(tt.key); got != tt.want {
+				t.Errorf("isCattleKey(%q) = %t, want %t", tt.key, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsCattleFinalizer(t *testing.T) {
+	tests := []struct {
+		name        string
+		keep, strip []string
+		finalizer   string
+		want        bool
+	}{
+		{name: "controller", finalizer: "controller.cattle.io/cluster-agent-controller-cleanup", want: true},
+		{name: "cluster scoped", finalizer: "clusterscoped.controller.cattle.io/cluster-agent-controller-cleanup_c-4xvmt", want: true},
+		{name: "wrangler", finalizer: "wrangler.cattle.io/auth-prov-v2-rolebinding", want: true},
+		{name: "other cattle prefix", finalizer: "fleet.cattle.io/foo", want: false},
+		{name: "kubernetes", finalizer: "kubernetes", want: false},
+		{name: "foreground deletion", finalizer: "foregroundDeletion", want: false},
+		{name: "kept", keep: []string{"wrangler.cattle.io/*"}, finalizer: "wrangler.cattle.io/foo", want: false},
+		{name: "stripped", strip: []string{"example.com/*"}, finalizer: "example.com/cleanup", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := newOwnershipMatcher(tt.keep, tt.strip)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := m.isCattleFinalizer(tt.finalizer); got != tt.want {
+				t.Errorf("isCattleFinalizer(%q) = %t, want %t", tt.finalizer, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHasCattleMark(t *testing.T) {
+	tests := []struct {
+		name        string
+		labels      map[string]string
+		annotations map[string]string
+		finalizers  []string
+		want        bool
+	}{
+		{name: "unmarked", labels: map[string]string{"app": "nginx"}, want: false},
+		{name: "creator label only", labels: map[string]string{cattleCreatorLabel: "norman"}, want: false},
+		{name: "cattle label", labels: map[string]string{"cattle.io/creator": "norman", "field.cattle.io/projectId": "p-1"}, want: true},
+		{name: "cattle annotation", annotations: map[string]string{"lifecycle.cattle.io/create.namespace-auth": "true"}, want: true},
+		{name: "cattle finalizer", finalizers: []string{"controller.cattle.io/namespace-auth"}, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := newOwnershipMatcher(nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			obj := unstructured.Unstructured{Object: map[string]interface{}{}}
+			obj.SetLabels(tt.labels)
+			obj.SetAnnotations(tt.annotations)
+			obj.SetFinalizers(tt.finalizers)
+			if got := m.hasCattleMark(obj); got != tt.want {
+				t.Errorf("hasCattleMark() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewOwnershipMatcherInvalidPattern(t *testing.T) {
+	if _, err := newOwnershipMatcher([]string{"[a-"}, nil); err == nil {
+		t.Error("expected an error for an invalid pattern")
+	}
+}
+
+func TestIsCattleNamespace(t *testing.T) {
+	r := &remover{namespace: "cattle-system", downstream: true}
+	tests := []struct {
+		namespace string
+		want      bool
+	}{
+		{namespace: "cattle-system", want: true},
+		{namespace: "cattle-fleet-system", want: true},
+		{namespace: "cattle-prometheus", want: true},
+		{namespace: "cattle-logging", want: true},
+		{namespace: "cattle-monitoring-system", want: true},
+		{namespace: "cattle-my-team", want: false},
+		{namespace: "kube-system", want: false},
+		{namespace: "fleet-default", want: false},
+	}
+	for _, tt := range tests {
+		if got := isCattleNamespace(r, tt.namespace); got != tt.want {
+			t.Errorf("isCattleNamespace(%q) = %t, want %t", tt.namespace, got, tt.want)
+		}
+	}
+}
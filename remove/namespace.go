@@ -0,0 +1,233 @@
+package remove
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rancher/system-tools/utils"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	DefaultNamespaceTimeout = 5 * time.Minute
+
+	namespacePollInterval = 2 * time.Second
+	namespaceTerminating  = "Terminating"
+)
+
+// namespaceFlags control how namespaces stuck in Terminating are resolved,
+// they are shared by remove and namespace unstick
+var namespaceFlags = []cli.Flag{
+	cli.DurationFlag{
+		Name:  "namespace-timeout",
+		Usage: "how long to wait for a deleted namespace to go away before resolving why it is stuck",
+		Value: DefaultNamespaceTimeout,
+	},
+	cli.BoolFlag{
+		Name:  "finalize-namespaces",
+		Usage: "finalize namespaces still stuck in Terminating through the finalize subresource, objects left in them are orphaned",
+	},
+}
+
+var UnstickFlags = append([]cli.Flag{
+	cli.StringFlag{
+		Name:   "kubeconfig,c",
+		EnvVar: "KUBECONFIG",
+		Usage:  "kubeconfig absolute path",
+	},
+}, append(namespaceFlags, scanFlags...)...)
+
+// conditions the namespace controller sets on a Terminating namespace
+// when it can't finish deleting it
+var namespaceDeletionConditions = map[string]bool{
+	"NamespaceDeletionDiscoveryFailure":           true,
+	"NamespaceDeletionGroupVersionParsingFailure": true,
+	"NamespaceDeletionContentFailure":             true,
+	"NamespaceContentRemaining":                   true,
+	"NamespaceFinalizersRemaining":                true,
+}
+
+func DoUnstickNamespace(ctx *cli.Context) error {
+	r, err := newRemover(ctx)
+	if err != nil {
+		return err
+	}
+	names := []string(ctx.Args())
+	if len(names) == 0 {
+		terminating, err := getTerminatingNamespaces(r)
+		if err != nil {
+			return err
+		}
+		for _, obj := range terminating {
+			names = append(names, obj.Name)
+		}
+	}
+	if len(names) == 0 {
+		logrus.Infof("No namespace is stuck in Terminating")
+		return nil
+	}
+	stuck := []string{}
+	for _, name := range names {
+		if err := unstickNamespace(r, name); err != nil {
+			logrus.Errorf("%v", err)
+			stuck = append(stuck, name)
+			continue
+		}
+		logrus.Infof("Namespace [%s] is gone", name)
+	}
+	if len(stuck) != 0 {
+		return fmt.Errorf("namespaces %v are still stuck in Terminating", stuck)
+	}
+	return nil
+}
+
+// deleteNamespaceAndWait deletes a namespace and waits for it to go away,
+// resolving what keeps it in Terminating when it doesn't.
+func deleteNamespaceAndWait(r *remover, name string) error {
+	if err := deleteNamespace(r, name); err != nil {
+		return err
+	}
+	gone, err := waitForNamespaceGone(r, name)
+	if err != nil || gone {
+		return err
+	}
+	return unstickNamespace(r, name)
+}
+
+func getNamespace(r *remover, name string) (*unstructured.Unstructured, error) {
+	return r.dynClient.Resource(namespaceGVR).Get(name, v1.GetOptions{})
+}
+
+func waitForNamespaceGone(r *remover, name string) (bool, error) {
+	logrus.Infof("waiting for namespace [%s] to be deleted..", name)
+	err := wait.PollImmediate(namespacePollInterval, r.ctx.Duration("namespace-timeout"), func() (bool, error) {
+		_, err := getNamespace(r, name)
+		if errors.IsNotFound(err) {
+			return true, nil
+		}
+		return false, err
+	})
+	if err == wait.ErrWaitTimeout {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// getNamespaceStuckReasons reads the deletion conditions of a Terminating
+// namespace, clusters older than 1.16 don't report any.
+func getNamespaceStuckReasons(ns *unstructured.Unstructured) []string {
+	reasons := []string{}
+	conditions, _, _ := unstructured.NestedSlice(ns.Object, "status", "conditions")
+	for _, c := range conditions {
+		condition, ok := c.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		conditionType, _ := condition["type"].(string)
+		if !namespaceDeletionConditions[conditionType] || condition["status"] != "True" {
+			continue
+		}
+		reasons = append(reasons, fmt.Sprintf("%s: %v", conditionType, condition["message"]))
+	}
+	return reasons
+}
+
+// unstickNamespace strips the Rancher finalizers off the objects left in a
+// Terminating namespace, and finalizes the namespace when the user opted in.
+func unstickNamespace(r *remover, name string) error {
+	ns, err := getNamespace(r, name)
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if phase, _, _ := unstructured.NestedString(ns.Object, "status", "phase"); phase != namespaceTerminating {
+		return fmt.Errorf("namespace [%s] is not being deleted", name)
+	}
+	reasons := getNamespaceStuckReasons(ns)
+	if len(reasons) == 0 {
+		reasons = append(reasons, "no reason reported by the cluster")
+	}
+	for _, reason := range reasons {
+		logrus.Warnf("namespace [%s] is stuck in Terminating: %s", name, reason)
+	}
+	stripped, err := stripNamespaceContentFinalizers(r, name)
+	if err != nil {
+		return err
+	}
+	if stripped != 0 {
+		gone, err := waitForNamespaceGone(r, name)
+		if err != nil || gone {
+			return err
+		}
+	}
+	if !r.ctx.Bool("finalize-namespaces") {
+		return fmt.Errorf("namespace [%s] is stuck in Terminating (%s), use --finalize-namespaces to force its deletion", name, strings.Join(reasons, "; "))
+	}
+	logrus.Warnf("finalizing namespace [%s], objects left in it are orphaned", name)
+	if err := finalizeNamespace(r, name); err != nil {
+		return err
+	}
+	gone, err := waitForNamespaceGone(r, name)
+	if err != nil {
+		return err
+	}
+	if !gone {
+		return fmt.Errorf("namespace [%s] is still stuck in Terminating after finalizing it", name)
+	}
+	return nil
+}
+
+// stripNamespaceContentFinalizers strips the Rancher marks off the objects left
+// in a namespace that are held by a Rancher finalizer, and returns their number.
+func stripNamespaceContentFinalizers(r *remover, name string) (int, error) {
+	if _, err := getAPIGroupResources(r); err != nil {
+		return 0, err
+	}
+	resources, err := getNamespacedResources(r)
+	if err != nil {
+		return 0, err
+	}
+	objects := []PlanObject{}
+	for _, gvr := range resources {
+		if err := listAll(r, gvr, name, func(items []unstructured.Unstructured) error {
+			for _, item := range items {
+				for _, f := range item.GetFinalizers() {
+					if r.matcher.isCattleFinalizer(f) {
+						objects = append(objects, newPlanObject(gvr, item.GetNamespace(), item.GetName(), ActionStripMarks))
+						break
+					}
+				}
+			}
+			return nil
+		}); err != nil {
+			logrus.Warnf("Can't list [%s] in namespace [%s]: %v", gvr.Resource, name, err)
+		}
+	}
+	for _, obj := range objects {
+		logrus.Infof("stripping Rancher finalizers from %s [%s]..", obj.GVRString(), obj.displayName())
+		if err := stripCattleMarks(r, obj); err != nil && !errors.IsNotFound(err) {
+			return 0, err
+		}
+	}
+	return len(objects), nil
+}
+
+func finalizeNamespace(r *remover, name string) error {
+	return utils.RetryTo(func() error {
+		ns, err := r.k8sClient.CoreV1().Namespaces().Get(name, v1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		ns.Spec.Finalizers = nil
+		_, err = r.k8sClient.CoreV1().Namespaces().Finalize(ns)
+		return err
+	})
+}
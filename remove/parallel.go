@@ -0,0 +1,79 @@
+package remove
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"golang.org/x/sync/errgroup"
+)
+
+const progressInterval = 10 * time.Second
+
+// forEachParallel calls f for every index in [0, n) from the given number of
+// workers. No new index is handed out after the first error, which is returned.
+func forEachParallel(workers, n int, f func(i int) error) error {
+	g, ctx := errgroup.WithContext(context.Background())
+	indexes := make(chan int)
+	g.Go(func() error {
+		defer close(indexes)
+		for i := 0; i < n; i++ {
+			select {
+			case indexes <- i:
+			case <-ctx.Done():
+				return nil
+			}
+		}
+		return nil
+	})
+	for w := 0; w < workers; w++ {
+		g.Go(func() error {
+			for i := range indexes {
+				if err := f(i); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	return g.Wait()
+}
+
+// progress logs how far a long running step got every progressInterval.
+type progress struct {
+	what  string
+	total int
+	done  int64
+	stop  chan struct{}
+}
+
+func startProgress(what string, total int) *progress {
+	p := &progress{
+		what:  what,
+		total: total,
+		stop:  make(chan struct{}),
+	}
+	go func() {
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				logrus.Infof("%s: %d/%d", p.what, atomic.LoadInt64(&p.done), p.total)
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+	return p
+}
+
+func (p *progress) inc() {
+	atomic.AddInt64(&p.done, 1)
+}
+
+func (p *progress) finish() {
+	close(p.stop)
+	logrus.Infof("%s: %d/%d", p.what, atomic.LoadInt64(&p.done), p.total)
+}
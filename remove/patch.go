@@ -0,0 +1,85 @@
+package remove
+
+import (
+	"encoding/json"
+
+	"github.com/rancher/system-tools/utils"
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// buildMarksPatch returns a JSON merge patch removing the Rancher labels,
+// annotations and finalizers of obj, or nil when there is nothing to remove.
+// A merge patch replaces lists as a whole, so when finalizers change the patch
+// carries the resourceVersion and fails with a conflict if they changed since.
+func buildMarksPatch(m *ownershipMatcher, obj *unstructured.Unstructured) ([]byte, error) {
+	metadata := map[string]interface{}{}
+	if labels := nullCattleKeys(m, obj.GetLabels()); len(labels) != 0 {
+		metadata["labels"] = labels
+	}
+	if annotations := nullCattleKeys(m, obj.GetAnnotations()); len(annotations) != 0 {
+		metadata["annotations"] = annotations
+	}
+	finalizers := m.cleanupFinalizers(obj.GetFinalizers())
+	if len(finalizers) != len(obj.GetFinalizers()) {
+		metadata["finalizers"] = finalizers
+		metadata["resourceVersion"] = obj.GetResourceVersion()
+	}
+	if len(metadata) == 0 {
+		return nil, nil
+	}
+	return json.Marshal(map[string]interface{}{
+		"metadata": metadata,
+	})
+}
+
+// nullCattleKeys maps the Rancher keys to null, which deletes them in a merge patch.
+func nullCattleKeys(m *ownershipMatcher, values map[string]string) map[string]interface{} {
+	keys := map[string]interface{}{}
+	for k := range values {
+		if m.isCattleKey(k) {
+			keys[k] = nil
+		}
+	}
+	return keys
+}
+
+func isPatchUnsupported(err error) bool {
+	return errors.IsMethodNotSupported(err) || errors.IsNotAcceptable(err) || errors.IsUnsupportedMediaType(err)
+}
+
+// stripCattleMarks patches the Rancher marks off an object. Resources that
+// don't accept patches on the main endpoint are patched through their status
+// subresource when it accepts them, and updated as a last resort.
+func stripCattleMarks(r *remover, obj PlanObject) error {
+	resourceClient := r.dynClient.Resource(obj.GVR()).Namespace(obj.Namespace)
+	return utils.RetryTo(func() error {
+		current, err := resourceClient.Get(obj.Name, v1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		patch, err := buildMarksPatch(r.matcher, current)
+		if err != nil || patch == nil {
+			return err
+		}
+		if r.supportsVerb(obj.GVR(), "", "patch") {
+			_, err = resourceClient.Patch(obj.Name, types.MergePatchType, patch, v1.UpdateOptions{})
+			if !isPatchUnsupported(err) {
+				return err
+			}
+		}
+		if r.supportsVerb(obj.GVR(), "status", "patch") {
+			_, err = resourceClient.Patch(obj.Name, types.MergePatchType, patch, v1.UpdateOptions{}, "status")
+			if !isPatchUnsupported(err) {
+				return err
+			}
+		}
+		logrus.Debugf("patch is not supported for %s [%s], updating it", obj.GVRString(), obj.displayName())
+		r.matcher.removeCattleMark(current)
+		_, err = resourceClient.Update(current, v1.UpdateOptions{})
+		return err
+	})
+}
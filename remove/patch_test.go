@@ -0,0 +1,59 @@
+package remove
+
+import (
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestBuildMarksPatch(t *testing.T) {
+	tests := []struct {
+		name        string
+		labels      map[string]string
+		annotations map[string]string
+		finalizers  []string
+		want        string
+	}{
+		{
+			name:   "nothing to strip",
+			labels: map[string]string{"app": "nginx"},
+			want:   "",
+		},
+		{
+			name:        "labels and annotations",
+			labels:      map[string]string{"app": "nginx", "field.cattle.io/projectId": "p-1"},
+			annotations: map[string]string{"lifecycle.cattle.io/create.namespace-auth": "true"},
+			want:        `{"metadata":{"annotations":{"lifecycle.cattle.io/create.namespace-auth":null},"labels":{"field.cattle.io/projectId":null}}}`,
+		},
+		{
+			name:       "finalizers carry the resource version",
+			finalizers: []string{"kubernetes", "controller.cattle.io/namespace-auth"},
+			want:       `{"metadata":{"finalizers":["kubernetes"],"resourceVersion":"42"}}`,
+		},
+		{
+			name:       "last finalizer",
+			finalizers: []string{"wrangler.cattle.io/auth-prov-v2-rolebinding"},
+			want:       `{"metadata":{"finalizers":[],"resourceVersion":"42"}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := newOwnershipMatcher(nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			obj := &unstructured.Unstructured{Object: map[string]interface{}{}}
+			obj.SetLabels(tt.labels)
+			obj.SetAnnotations(tt.annotations)
+			obj.SetFinalizers(tt.finalizers)
+			obj.SetResourceVersion("42")
+			patch, err := buildMarksPatch(m, obj)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(patch) != tt.want {
+				t.Errorf("buildMarksPatch() = %s, want %s", patch, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+package remove
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+const (
+	ActionDelete     = "delete"
+	ActionStripMarks = "strip-marks"
+
+	PlanFormatTable = "table"
+	PlanFormatJSON  = "json"
+)
+
+type PlanObject struct {
+	Group     string `json:"group,omitempty"`
+	Version   string `json:"version"`
+	Resource  string `json:"resource"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name"`
+	Action    string `json:"action"`
+}
+
+type PhasePlan struct {
+	Phase   string         `json:"phase"`
+	Skipped bool           `json:"skipped,omitempty"`
+	Counts  map[string]int `json:"counts"`
+	Objects []PlanObject   `json:"objects"`
+}
+
+type Plan struct {
+	Namespace string      `json:"namespace"`
+	Phases    []PhasePlan `json:"phases"`
+}
+
+func newPlanObject(gvr schema.GroupVersionResource, namespace, name, action string) PlanObject {
+	return PlanObject{
+		Group:     gvr.Group,
+		Version:   gvr.Version,
+		Resource:  gvr.Resource,
+		Namespace: namespace,
+		Name:      name,
+		Action:    action,
+	}
+}
+
+func (o PlanObject) GVR() schema.GroupVersionResource {
+	return schema.GroupVersionResource{
+		Group:    o.Group,
+		Version:  o.Version,
+		Resource: o.Resource,
+	}
+}
+
+func (o PlanObject) GVRString() string {
+	if len(o.Group) == 0 {
+		return fmt.Sprintf("%s/%s", o.Version, o.Resource)
+	}
+	return fmt.Sprintf("%s/%s/%s", o.Group, o.Version, o.Resource)
+}
+
+func (o PlanObject) key() string {
+	return fmt.Sprintf("%s/%s/%s/%s", o.Group, o.Resource, o.Namespace, o.Name)
+}
+
+func (o PlanObject) displayName() string {
+	if len(o.Namespace) == 0 {
+		return o.Name
+	}
+	return fmt.Sprintf("%s/%s", o.Namespace, o.Name)
+}
+
+func sortPlanObjects(objects []PlanObject) {
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].key() < objects[j].key()
+	})
+}
+
+func countByGVR(objects []PlanObject) map[string]int {
+	counts := map[string]int{}
+	for _, obj := range objects {
+		counts[obj.GVRString()]++
+	}
+	return counts
+}
+
+// buildRemovalPlan runs the discovery of every phase against the current state
+// of the cluster. Objects deleted by an earlier phase are not repeated in later ones.
+func buildRemovalPlan(r *remover) (*Plan, error) {
+	plan := &Plan{
+		Namespace: r.namespace,
+		Phases:    []PhasePlan{},
+	}
+	planned := map[string]bool{}
+	for _, p := range r.phases {
+		if !r.selected[p.name] {
+			plan.Phases = append(plan.Phases, PhasePlan{
+				Phase:   p.name,
+				Skipped: true,
+				Counts:  map[string]int{},
+				Objects: []PlanObject{},
+			})
+			continue
+		}
+		logrus.Infof("Discovering objects for phase [%s]", p.name)
+		objects, err := p.discover(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to discover objects for phase [%s]: %v", p.name, err)
+		}
+		phasePlan := PhasePlan{
+			Phase:   p.name,
+			Objects: []PlanObject{},
+		}
+		for _, obj := range objects {
+			if obj.Action == ActionDelete {
+				if planned[obj.key()] {
+					continue
+				}
+				planned[obj.key()] = true
+			}
+			phasePlan.Objects = append(phasePlan.Objects, obj)
+		}
+		phasePlan.Counts = countByGVR(phasePlan.Objects)
+		plan.Phases = append(plan.Phases, phasePlan)
+	}
+	return plan, nil
+}
+
+func printPlan(w io.Writer, plan *Plan, format string) error {
+	if format == PlanFormatJSON {
+		out, err := json.MarshalIndent(plan, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(out))
+		return err
+	}
+	return printPlanTable(w, plan)
+}
+
+func printPlanTable(w io.Writer, plan *Plan) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "Removal plan for Rancher management plane in namespace [%s]\n", plan.Namespace)
+	for i, phasePlan := range plan.Phases {
+		if phasePlan.Skipped {
+			fmt.Fprintf(tw, "\nPHASE %d: %s (skipped)\n", i+1, phasePlan.Phase)
+			continue
+		}
+		fmt.Fprintf(tw, "\nPHASE %d: %s (%d objects)\n", i+1, phasePlan.Phase, len(phasePlan.Objects))
+		if len(phasePlan.Objects) == 0 {
+			continue
+		}
+		gvrs := []string{}
+		for gvr := range phasePlan.Counts {
+			gvrs = append(gvrs, gvr)
+		}
+		sort.Strings(gvrs)
+		fmt.Fprintf(tw, "  RESOURCE\tCOUNT\n")
+		for _, gvr := range gvrs {
+			fmt.Fprintf(tw, "  %s\t%d\n", gvr, phasePlan.Counts[gvr])
+		}
+		fmt.Fprintf(tw, "\n  ACTION\tRESOURCE\tNAMESPACE\tNAME\n")
+		for _, obj := range phasePlan.Objects {
+			fmt.Fprintf(tw, "  %s\t%s\t%s\t%s\n", obj.Action, obj.GVRString(), obj.Namespace, obj.Name)
+		}
+	}
+	return tw.Flush()
+}
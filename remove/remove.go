@@ -4,11 +4,13 @@ import (
 	"bufio"
 	"fmt"
 	"os"
+	"os/signal"
 	"strings"
+	"sync"
+	"syscall"
 
 	"github.com/rancher/system-tools/clients"
 	"github.com/rancher/system-tools/utils"
-	"github.com/rancher/types/apis/management.cattle.io/v3"
 	"github.com/rancher/types/config"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
@@ -16,13 +18,16 @@ import (
 	"k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 )
 
 const (
-	CattleControllerName = "controller.cattle.io"
-	CattleLabelBase      = "cattle.io"
-	DefaultRetryCount    = 3
+	DefaultRetryCount = 3
+	DefaultWorkers    = 10
+	DefaultQPS        = 20
 )
 
 var staticClusterRoles = []string{
@@ -34,19 +39,237 @@ var staticClusterRoles = []string{
 var cattleListOptions = v1.ListOptions{
 	LabelSelector: "cattle.io/creator=norman",
 }
-var deletePolicy = v1.DeletePropagationOrphan
-var deleteGracePeriod int64 = 120
 var ForceFlag cli.Flag = cli.BoolFlag{
 	Name:  "force",
 	Usage: "Force removal of the cluster",
 }
 
+var DownstreamFlag cli.Flag = cli.BoolFlag{
+	Name:  "downstream",
+	Usage: "clean the Rancher agents off a downstream cluster instead of removing the management plane",
+}
+
+var RemoveFlags = append([]cli.Flag{
+	ForceFlag,
+	DownstreamFlag,
+	cli.BoolFlag{
+		Name:  "dry-run",
+		Usage: "print the removal plan without removing anything",
+	},
+	cli.StringFlag{
+		Name:  "format",
+		Usage: "dry-run plan format: table or json",
+		Value: PlanFormatTable,
+	},
+	cli.StringFlag{
+		Name:  "backup",
+		Usage: "backup archive written before removal (default: rancher-removal-backup-<timestamp>.tar.gz)",
+	},
+	cli.BoolFlag{
+		Name:  "skip-backup",
+		Usage: "remove without writing a backup archive first",
+	},
+	cli.BoolFlag{
+		Name:  "interactive",
+		Usage: "show a summary before each phase and ask whether to continue, skip it, list its objects or abort",
+	},
+	cli.StringFlag{
+		Name:  "report",
+		Usage: "file listing the outcome of every object, written as YAML when it ends with .yaml or .yml and as JSON otherwise",
+	},
+	cli.StringFlag{
+		Name:  "journal",
+		Usage: "file recording the progress of the removal (default: rancher-removal-journal-<mode>-<cluster id>.json)",
+	},
+	cli.BoolFlag{
+		Name:  "resume",
+		Usage: "resume an interrupted removal from its journal",
+	},
+	cli.StringFlag{
+		Name:  "include",
+		Usage: "comma separated list of the only removal phases to run",
+	},
+	cli.StringFlag{
+		Name:  "exclude",
+		Usage: "comma separated list of removal phases to skip",
+	},
+	cli.StringFlag{
+		Name:  "profile",
+		Usage: "removal profile file selecting the phases to run",
+	},
+}, append(append(deleteFlags, namespaceFlags...), scanFlags...)...)
+
+// scanFlags tune how the cluster is scanned for Rancher objects, they are
+// shared by remove and verify
+var scanFlags = []cli.Flag{
+	cli.IntFlag{
+		Name:  "workers",
+		Usage: "number of objects scanned and cleaned in parallel",
+		Value: DefaultWorkers,
+	},
+	cli.Float64Flag{
+		Name:  "qps",
+		Usage: "maximum number of requests per second sent while scanning and cleaning objects",
+		Value: DefaultQPS,
+	},
+	cli.StringFlag{
+		Name:  "keep-keys",
+		Usage: "comma separated list of label, annotation and finalizer patterns to keep, e.g. 'example.cattle.io/*'",
+	},
+	cli.StringFlag{
+		Name:  "strip-keys",
+		Usage: "comma separated list of label, annotation and finalizer patterns to strip along with the Rancher ones",
+	},
+}
+
+var (
+	namespaceGVR          = schema.GroupVersionResource{Version: "v1", Resource: "namespaces"}
+	deploymentGVR         = schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}
+	clusterRoleGVR        = schema.GroupVersionResource{Group: "rbac.authorization.k8s.io", Version: "v1", Resource: "clusterroles"}
+	clusterRoleBindingGVR = schema.GroupVersionResource{Group: "rbac.authorization.k8s.io", Version: "v1", Resource: "clusterrolebindings"}
+	projectGVR            = schema.GroupVersionResource{Group: "management.cattle.io", Version: "v3", Resource: "projects"}
+	nodeGVR               = schema.GroupVersionResource{Group: "management.cattle.io", Version: "v3", Resource: "nodes"}
+	clusterGVR            = schema.GroupVersionResource{Group: "management.cattle.io", Version: "v3", Resource: "clusters"}
+	userGVR               = schema.GroupVersionResource{Group: "management.cattle.io", Version: "v3", Resource: "users"}
+)
+
+// phase is a single step of the removal. discover finds the objects the step
+// acts on without changing anything, run acts on them.
+type phase struct {
+	name     string
+	discover func(r *remover) ([]PlanObject, error)
+	run      func(r *remover, objects []PlanObject) error
+}
+
+var removalPhases = []phase{
+	{name: "webhooks", discover: getRancherWebhooksAndAPIServices, run: removeRancherWebhooks},
+	{name: "deployment", discover: getCattleDeployments, run: removeCattleDeployment},
+	{name: "helm-releases", discover: getHelmReleaseObjects, run: removeHelmReleases},
+	{name: "cluster-role-bindings", discover: getCattleClusterRoleBindings, run: clusterRoleBindginsCleanup},
+	{name: "cluster-roles", discover: getCattleClusterRoles, run: clusterRolesCleanup},
+	{name: "cattle-marks", discover: getCattleMarkedResources, run: removeCattleAnnotationsFinalizersLabels},
+	{name: "projects", discover: getProjects, run: projectsCleanup},
+	{name: "nodes", discover: getNodes, run: nodesCleanup},
+	{name: "clusters", discover: getClusters, run: clustersCleanup},
+	{name: "users", discover: getUsers, run: usersCleanup},
+	{name: "cattle-resources", discover: getCattleAPIGroupResources, run: removeCattleAPIGroupResources},
+	{name: "crds", discover: getCattleCRDs, run: removeCattleCRDs},
+	{name: "namespace", discover: getRancherNamespaces, run: rancherNamespaceCleanup},
+}
+
+type remover struct {
+	ctx        *cli.Context
+	namespace  string
+	k8sClient  *kubernetes.Clientset
+	management *config.ManagementContext
+	dynClient  dynamic.Interface
+	discClient discovery.DiscoveryInterface
+	workers    int
+	downstream bool
+	// phases of the management plane or downstream removal
+	phases []phase
+	// cached by the first discovery of the API groups
+	apiResources  []apiGroupResources
+	resourceIndex map[schema.GroupVersionResource]v1.APIResource
+	// cached by the first backup of a namespace's contents
+	namespacedResources []schema.GroupVersionResource
+	journal             *Journal
+	report              *Report
+	// delete options and wait behaviour of every phase
+	deleteSemantics map[string]deleteSemantics
+	// ask the operator before each phase
+	interactive bool
+	stdin       *bufio.Reader
+	// phases selected by the removal profile
+	selected map[string]bool
+	matcher  *ownershipMatcher
+	// name of the running phase
+	phase string
+	// partial failures that didn't stop the removal
+	warnings []string
+	mu       sync.Mutex
+}
+
+func newRemover(ctx *cli.Context) (*remover, error) {
+	profile, err := getProfile(ctx)
+	if err != nil {
+		return nil, err
+	}
+	downstream := ctx.Bool("downstream")
+	phases, requirements := removalPhases, phaseRequirements
+	if downstream {
+		phases, requirements = downstreamPhases, downstreamPhaseRequirements
+	}
+	selected, err := selectPhases(phases, requirements, profile)
+	if err != nil {
+		return nil, err
+	}
+	matcher, err := newOwnershipMatcher(profile.KeepKeys, profile.StripKeys)
+	if err != nil {
+		return nil, err
+	}
+	if downstream {
+		matcher.builtinKeep = distributionKeyPatterns
+	}
+	semantics, err := resolveDeleteSemantics(ctx, profile, phases)
+	if err != nil {
+		return nil, err
+	}
+	restConfig, err := clients.GetRestConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	management, err := config.NewManagementContext(*restConfig)
+	if err != nil {
+		return nil, err
+	}
+	k8sClient, err := clients.GetClientSet(ctx)
+	if err != nil {
+		return nil, err
+	}
+	workers := ctx.Int("workers")
+	qps := ctx.Float64("qps")
+	if workers < 1 || qps <= 0 {
+		return nil, fmt.Errorf("workers and qps must be positive")
+	}
+	// the dynamic client is shared by all workers, its rate limiter is the QPS budget
+	dynConfig := rest.CopyConfig(restConfig)
+	dynConfig.QPS = float32(qps)
+	dynConfig.Burst = int(qps) + 1
+	dynClient, err := dynamic.NewForConfig(dynConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &remover{
+		ctx:        ctx,
+		namespace:  ctx.String("namespace"),
+		k8sClient:  k8sClient,
+		management: management,
+		dynClient:  dynClient,
+		discClient: k8sClient.Discovery(),
+		workers:    workers,
+		downstream: downstream,
+		phases:     phases,
+		selected:   selected,
+		matcher:    matcher,
+
+		deleteSemantics: semantics,
+	}, nil
+}
+
 func DoRemoveRancher(ctx *cli.Context) error {
 	cattleNamespace := ctx.String("namespace")
+	if ctx.Bool("dry-run") {
+		return doRemovePlan(ctx)
+	}
+	target := "Rancher Management Plane"
+	if ctx.Bool("downstream") {
+		target = "Rancher agents"
+	}
+	reader := bufio.NewReader(os.Stdin)
 	force := ctx.Bool("force")
 	if !force {
-		reader := bufio.NewReader(os.Stdin)
-		fmt.Printf("Are you sure you want to remove Rancher Management Plane in Namespace [%s] [y/n]: ", cattleNamespace)
+		fmt.Printf("Are you sure you want to remove %s in Namespace [%s] [y/n]: ", target, cattleNamespace)
 		input, err := reader.ReadString('\n')
 		input = strings.TrimSpace(input)
 		if err != nil {
@@ -56,267 +279,406 @@ func DoRemoveRancher(ctx *cli.Context) error {
 			return nil
 		}
 	}
-	logrus.Infof("Removing Rancher management plane in namespace: [%s]", cattleNamespace)
+	logrus.Infof("Removing %s in namespace: [%s]", target, cattleNamespace)
 	// setup
 	logrus.Infof("Getting connection configuration")
-	restConfig, err := clients.GetRestConfig(ctx)
+	// the report covers failures before anything is removed too
+	report := newReport(ctx.String("report"), cattleNamespace, ctx.Bool("downstream"))
+	r, err := newRemover(ctx)
 	if err != nil {
-		return err
+		return report.finish(err, nil)
 	}
-	management, err := config.NewManagementContext(*restConfig)
+	r.report = report
+	r.interactive = ctx.Bool("interactive")
+	r.stdin = reader
+	journalPath, err := getJournalPath(ctx.String("journal"), r.k8sClient, r.downstream)
 	if err != nil {
-		return err
+		return r.report.finish(err, r.getWarnings())
 	}
-	k8sClient, err := clients.GetClientSet(ctx)
+	r.journal, err = openJournal(journalPath, cattleNamespace, r.downstream, r.phases, ctx.Bool("resume"))
 	if err != nil {
-		return err
+		return r.report.finish(err, r.getWarnings())
+	}
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigChan
+		logrus.Infof("user interrupt..saving removal journal [%s]", journalPath)
+		if err := r.journal.save(); err != nil {
+			logrus.Errorf("failed to save removal journal: %v", err)
+		}
+		r.report.abort(r.getWarnings())
+		os.Exit(ExitAborted)
+	}()
+
+	err = removeRancher(r)
+	r.journal.printReport(os.Stdout)
+	// a partial removal keeps its journal so it can be resumed
+	if r.report.result(err, r.getWarnings()) == ResultSuccess {
+		finished, jerr := r.journal.finish()
+		if jerr != nil {
+			r.warn("failed to move aside the journal of the finished removal [%s]: %v", journalPath, jerr)
+		} else if len(finished) != 0 {
+			logrus.Infof("Removal finished, its journal was moved to [%s]", finished)
+		}
 	}
-	if err := utils.RetryWithCount(func() error {
-		return removeCattleDeployment(ctx)
-	}, DefaultRetryCount); err != nil {
+	if err := r.report.finish(err, r.getWarnings()); err != nil {
 		return err
 	}
+	logrus.Infof("%s removed successfully", target)
+	return nil
+}
 
-	if err := utils.RetryWithCount(func() error {
-		return clusterRoleBindginsCleanup(k8sClient)
-	}, DefaultRetryCount); err != nil {
-		return err
+func removeRancher(r *remover) error {
+	if len(r.journal.BackupFile) != 0 {
+		logrus.Infof("Backup was written to [%s] by the interrupted removal", r.journal.BackupFile)
+	} else if !r.ctx.Bool("skip-backup") {
+		backupFile := getBackupFileName(r.ctx.String("backup"))
+		if err := writeRemovalBackup(r, backupFile); err != nil {
+			return fmt.Errorf("failed to write backup, nothing was removed: %v", err)
+		}
+		if err := r.journal.setBackupFile(backupFile); err != nil {
+			return err
+		}
 	}
+	return runRemovalPhases(r)
+}
 
-	if err := utils.RetryWithCount(func() error {
-		return clusterRolesCleanup(k8sClient)
-	}, DefaultRetryCount); err != nil {
-		return err
+func runRemovalPhases(r *remover) error {
+	for _, p := range r.phases {
+		jp := r.journal.phase(p.name)
+		if jp.Status == PhaseCompleted {
+			logrus.Infof("Skipping phase [%s], it was completed by a previous run", p.name)
+			continue
+		}
+		if !r.selected[p.name] {
+			logrus.Infof("Skipping phase [%s], it is not selected", p.name)
+			if err := r.journal.skipPhase(p.name); err != nil {
+				return err
+			}
+			continue
+		}
+		r.phase = p.name
+		// a resumed phase picks up the objects discovered by the interrupted run
+		discovered := jp.Objects
+		if r.interactive {
+			if discovered == nil {
+				var err error
+				if discovered, err = p.discover(r); err != nil {
+					return fmt.Errorf("phase [%s] failed: %v", p.name, err)
+				}
+			}
+			decision, err := confirmPhase(r, p.name, discovered)
+			if err != nil {
+				return err
+			}
+			if decision == DecisionAbort {
+				return errRemovalAborted
+			}
+			if decision == DecisionSkip {
+				if err := r.journal.skipPhase(p.name); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		if err := utils.RetryWithCount(func() error {
+			objects := discovered
+			discovered = nil
+			if objects == nil {
+				var err error
+				if objects, err = p.discover(r); err != nil {
+					return err
+				}
+			}
+			pending, err := r.journal.startPhase(p.name, objects)
+			if err != nil {
+				return err
+			}
+			if err := p.run(r, pending); err != nil {
+				return err
+			}
+			return waitForDeletion(r, objects)
+		}, DefaultRetryCount); err != nil {
+			return fmt.Errorf("phase [%s] failed: %v", p.name, err)
+		}
+		if err := r.journal.completePhase(p.name); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	if err := utils.RetryWithCount(func() error {
-		return removeCattleAnnotationsFinalizersLabels(ctx)
-	}, DefaultRetryCount); err != nil {
+// process runs the action of a phase on a single object and records the
+// outcome in the journal and the report, objects that are already gone count
+// as processed.
+func (r *remover) process(obj PlanObject, action func() error) error {
+	err := action()
+	if err != nil && !errors.IsNotFound(err) {
+		if journalErr := r.journal.objectFailed(r.phase, obj, err); journalErr != nil {
+			logrus.Warnf("failed to update removal journal: %v", journalErr)
+		}
+		r.report.record(r.phase, obj, OutcomeFailed, err)
 		return err
 	}
-
-	if err := utils.RetryWithCount(func() error {
-		return projectsCleanup(management, k8sClient)
-	}, DefaultRetryCount); err != nil {
-		return err
+	switch {
+	case err != nil:
+		r.report.record(r.phase, obj, OutcomeSkipped, err)
+	case obj.Action == ActionStripMarks:
+		r.report.record(r.phase, obj, OutcomePatched, nil)
+	default:
+		r.report.record(r.phase, obj, OutcomeDeleted, nil)
+	}
+	return r.journal.objectProcessed(r.phase, obj)
+}
+
+// warn logs a partial failure that doesn't stop the removal and records it
+// for the removal report.
+func (r *remover) warn(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	logrus.Warn(msg)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, w := range r.warnings {
+		if w == msg {
+			return
+		}
 	}
-
-	if err := utils.RetryWithCount(func() error {
-		return nodesCleanup(management)
-	}, DefaultRetryCount); err != nil {
-		return err
+	r.warnings = append(r.warnings, msg)
+	if r.journal == nil {
+		return
 	}
-
-	if err := utils.RetryWithCount(func() error {
-		return clustersCleanup(management, k8sClient)
-	}, DefaultRetryCount); err != nil {
-		return err
+	if err := r.journal.addWarning(msg); err != nil {
+		logrus.Warnf("failed to update removal journal: %v", err)
 	}
+}
 
-	if err := utils.RetryWithCount(func() error {
-		return usersCleanup(management, k8sClient)
-	}, DefaultRetryCount); err != nil {
-		return err
-	}
+func (r *remover) getWarnings() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string{}, r.warnings...)
+}
 
-	if err := utils.RetryWithCount(func() error {
-		return removeCattleAPIGroupResources(ctx)
-	}, DefaultRetryCount); err != nil {
-		return err
+func doRemovePlan(ctx *cli.Context) error {
+	format := ctx.String("format")
+	if format != PlanFormatTable && format != PlanFormatJSON {
+		return fmt.Errorf("unsupported plan format [%s], use %s or %s", format, PlanFormatTable, PlanFormatJSON)
 	}
-
-	if err := utils.RetryWithCount(func() error {
-		return removeCattleCRDs(ctx)
-	}, DefaultRetryCount); err != nil {
+	logrus.Infof("Building removal plan for Rancher management plane in namespace: [%s]", ctx.String("namespace"))
+	r, err := newRemover(ctx)
+	if err != nil {
 		return err
 	}
-	// final cleanup
-	logrus.Infof("Removing Rancher Namespace [%s]", cattleNamespace)
-	if err := utils.RetryWithCount(func() error {
-		return deleteNamespace(k8sClient, cattleNamespace)
-	}, DefaultRetryCount); err != nil && !errors.IsNotFound(err) {
+	plan, err := buildRemovalPlan(r)
+	if err != nil {
 		return err
 	}
-	logrus.Infof("Successfully removed namespace [%s]", cattleNamespace)
-	logrus.Infof("Rancher Management Plane removed successfully")
-	return nil
+	return printPlan(os.Stdout, plan, format)
 }
 
-func removeCattleDeployment(ctx *cli.Context) error {
-	logrus.Infof("Removing Cattle deployment")
-	clientSet, err := clients.GetClientSet(ctx)
+// deleteObject deletes an object with the delete options of the running phase.
+func deleteObject(r *remover, obj PlanObject) error {
+	return r.dynClient.Resource(obj.GVR()).Namespace(obj.Namespace).Delete(obj.Name, r.deleteOptions())
+}
+
+func deleteNamespace(r *remover, name string) error {
+	return utils.RetryTo(func() error {
+		return r.k8sClient.CoreV1().Namespaces().Delete(name, r.namespaceDeleteOptions())
+	})
+}
+
+// getCattleDeployments lists the deployments of --namespace and of the
+// Rancher companion namespaces.
+func getCattleDeployments(r *remover) ([]PlanObject, error) {
+	namespaces, err := getRancherNamespaceNames(r)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	cattleNamespace := ctx.String("namespace")
-	deployments, err := clientSet.AppsV1().Deployments(cattleNamespace).List(v1.ListOptions{})
-	if err != nil {
-		return err
+	objects := []PlanObject{}
+	for _, namespace := range namespaces {
+		deployments, err := r.k8sClient.AppsV1().Deployments(namespace).List(v1.ListOptions{})
+		if err != nil {
+			return nil, err
+		}
+		for _, deployment := range deployments.Items {
+			objects = append(objects, newPlanObject(deploymentGVR, deployment.Namespace, deployment.Name, ActionDelete))
+		}
 	}
-	for _, deployment := range deployments.Items {
-		if err := clientSet.AppsV1().Deployments(cattleNamespace).Delete(deployment.Name, &v1.DeleteOptions{}); err != nil {
+	return objects, nil
+}
+
+func removeCattleDeployment(r *remover, objects []PlanObject) error {
+	logrus.Infof("Removing Cattle deployment")
+	for _, obj := range objects {
+		if err := r.process(obj, func() error {
+			return deleteObject(r, obj)
+		}); err != nil {
 			return err
 		}
 	}
-	logrus.Infof("Removed Cattle deployment succuessfully")
+	logrus.Infof("Removed Cattle deployment successfully")
 	return nil
 }
 
-func getProjectList(mgmtCtx *config.ManagementContext) ([]v3.Project, error) {
-	projectList, err := mgmtCtx.Management.Projects("").List(v1.ListOptions{})
+func getCattleClusterRoleBindings(r *remover) ([]PlanObject, error) {
+	crbList, err := r.k8sClient.RbacV1().ClusterRoleBindings().List(cattleListOptions)
 	if err != nil {
 		return nil, err
 	}
-
-	return projectList.Items, nil
+	objects := []PlanObject{}
+	for _, crb := range crbList.Items {
+		objects = append(objects, newPlanObject(clusterRoleBindingGVR, "", crb.Name, ActionDelete))
+	}
+	return objects, nil
 }
 
-func getUserList(mgmtCtx *config.ManagementContext) ([]v3.User, error) {
-	userList, err := mgmtCtx.Management.Users("").List(v1.ListOptions{})
+func getCattleClusterRolesList(client *kubernetes.Clientset) ([]string, error) {
+	crList, err := client.RbacV1().ClusterRoles().List(cattleListOptions)
 	if err != nil {
 		return nil, err
 	}
-
-	return userList.Items, nil
+	crNames := []string{}
+	for _, cr := range crList.Items {
+		crNames = append(crNames, cr.Name)
+	}
+	return crNames, nil
 }
 
-func getNodesList(mgmtCtx *config.ManagementContext) ([]v3.Node, error) {
-	nodesList, err := mgmtCtx.Management.Nodes("").List(v1.ListOptions{})
+func getCattleClusterRoles(r *remover) ([]PlanObject, error) {
+	clusterRoles, err := getCattleClusterRolesList(r.k8sClient)
 	if err != nil {
 		return nil, err
 	}
-
-	return nodesList.Items, nil
+	for _, name := range staticClusterRoles {
+		if _, err := r.k8sClient.RbacV1().ClusterRoles().Get(name, v1.GetOptions{}); err != nil {
+			if errors.IsNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+		clusterRoles = append(clusterRoles, name)
+	}
+	objects := []PlanObject{}
+	for _, name := range clusterRoles {
+		objects = append(objects, newPlanObject(clusterRoleGVR, "", name, ActionDelete))
+	}
+	return objects, nil
 }
 
-func getClusterList(mgmtCtx *config.ManagementContext) ([]v3.Cluster, error) {
-	clusterList, err := mgmtCtx.Management.Clusters("").List(v1.ListOptions{})
+func getNamespacesList(client *kubernetes.Clientset) ([]string, error) {
+
+	nsList, err := client.CoreV1().Namespaces().List(v1.ListOptions{})
 	if err != nil {
 		return nil, err
 	}
-
-	return clusterList.Items, nil
-}
-
-func deleteProject(mgmtCtx *config.ManagementContext, project v3.Project) error {
-	return mgmtCtx.Management.Projects(project.Namespace).Delete(project.Name, &v1.DeleteOptions{
-		PropagationPolicy:  &deletePolicy,
-		GracePeriodSeconds: &deleteGracePeriod,
-	})
-
-}
-
-func deleteCluster(mgmtCtx *config.ManagementContext, cluster v3.Cluster) error {
-
-	return mgmtCtx.Management.Clusters("").Delete(cluster.Name, &v1.DeleteOptions{
-		PropagationPolicy:  &deletePolicy,
-		GracePeriodSeconds: &deleteGracePeriod,
-	})
-}
-
-func deleteUser(mgmtCtx *config.ManagementContext, user v3.User) error {
-
-	return mgmtCtx.Management.Users("").Delete(user.Name, &v1.DeleteOptions{
-		PropagationPolicy:  &deletePolicy,
-		GracePeriodSeconds: new(int64),
-	})
-}
-
-func deleteNode(mgmtCtx *config.ManagementContext, node v3.Node) error {
-	return mgmtCtx.Management.Nodes("local").Delete(node.Name, &v1.DeleteOptions{
-		PropagationPolicy:  &deletePolicy,
-		GracePeriodSeconds: &deleteGracePeriod,
-	})
-}
-func deleteNamespace(client *kubernetes.Clientset, name string) error {
-	return utils.RetryTo(func() error {
-		return client.CoreV1().Namespaces().Delete(name, &v1.DeleteOptions{
-			PropagationPolicy:  &deletePolicy,
-			GracePeriodSeconds: new(int64),
-		})
-	})
-}
-
-func deleteClusterRole(client *kubernetes.Clientset, name string) error {
-	return client.RbacV1().ClusterRoles().Delete(name, &v1.DeleteOptions{
-		PropagationPolicy:  &deletePolicy,
-		GracePeriodSeconds: new(int64),
-	})
+	nsNames := []string{}
+	for _, ns := range nsList.Items {
+		nsNames = append(nsNames, ns.Name)
+	}
+	return nsNames, nil
 }
 
-func deleteClusterRoleBinding(client *kubernetes.Clientset, name string) error {
-
-	return client.RbacV1().ClusterRoleBindings().Delete(name, &v1.DeleteOptions{
-		PropagationPolicy:  &deletePolicy,
-		GracePeriodSeconds: new(int64),
-	})
+// getNamespacesSet returns the names of the namespaces that currently exist,
+// Rancher creates a namespace for most projects, clusters and users but not all of them.
+func getNamespacesSet(client *kubernetes.Clientset) (map[string]bool, error) {
+	nsNames, err := getNamespacesList(client)
+	if err != nil {
+		return nil, err
+	}
+	namespaces := map[string]bool{}
+	for _, name := range nsNames {
+		namespaces[name] = true
+	}
+	return namespaces, nil
 }
 
-func getCattleClusterRoleBindingsList(client *kubernetes.Clientset) ([]string, error) {
-	crbList, err := client.RbacV1().ClusterRoleBindings().List(cattleListOptions)
+func getProjects(r *remover) ([]PlanObject, error) {
+	projectList, err := r.management.Management.Projects("").List(v1.ListOptions{})
 	if err != nil {
 		return nil, err
 	}
-	crbNames := []string{}
-	for _, crb := range crbList.Items {
-		crbNames = append(crbNames, crb.Name)
+	namespaces, err := getNamespacesSet(r.k8sClient)
+	if err != nil {
+		return nil, err
 	}
-
-	return crbNames, nil
+	objects := []PlanObject{}
+	for _, project := range projectList.Items {
+		if namespaces[project.Name] {
+			objects = append(objects, newPlanObject(namespaceGVR, "", project.Name, ActionDelete))
+		}
+		objects = append(objects, newPlanObject(projectGVR, project.Namespace, project.Name, ActionDelete))
+	}
+	return objects, nil
 }
 
-func getCattleClusterRolesList(client *kubernetes.Clientset) ([]string, error) {
-	crList, err := client.RbacV1().ClusterRoles().List(cattleListOptions)
+func getNodes(r *remover) ([]PlanObject, error) {
+	nodesList, err := r.management.Management.Nodes("").List(v1.ListOptions{})
 	if err != nil {
 		return nil, err
 	}
-	crNames := []string{}
-	for _, cr := range crList.Items {
-		crNames = append(crNames, cr.Name)
+	objects := []PlanObject{}
+	for _, node := range nodesList.Items {
+		objects = append(objects, newPlanObject(nodeGVR, node.Namespace, node.Name, ActionDelete))
 	}
-	return crNames, nil
+	return objects, nil
 }
 
-func cleanupFinalizers(finalizers []string) []string {
-	updatedFinalizers := []string{}
-	for _, f := range finalizers {
-		if strings.Contains(f, CattleControllerName) {
-			continue
+func getClusters(r *remover) ([]PlanObject, error) {
+	clusterList, err := r.management.Management.Clusters("").List(v1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	namespaces, err := getNamespacesSet(r.k8sClient)
+	if err != nil {
+		return nil, err
+	}
+	objects := []PlanObject{}
+	for _, cluster := range clusterList.Items {
+		if namespaces[cluster.Name] {
+			objects = append(objects, newPlanObject(namespaceGVR, "", cluster.Name, ActionDelete))
 		}
-		updatedFinalizers = append(updatedFinalizers, f)
+		objects = append(objects, newPlanObject(clusterGVR, "", cluster.Name, ActionDelete))
 	}
-	return updatedFinalizers
+	return objects, nil
 }
 
-func cleanupAnnotationsLabels(m map[string]string) map[string]string {
-	for k := range m {
-		if strings.Contains(k, CattleLabelBase) {
-			delete(m, k)
+func getUsers(r *remover) ([]PlanObject, error) {
+	userList, err := r.management.Management.Users("").List(v1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	namespaces, err := getNamespacesSet(r.k8sClient)
+	if err != nil {
+		return nil, err
+	}
+	objects := []PlanObject{}
+	for _, user := range userList.Items {
+		if namespaces[user.Name] {
+			objects = append(objects, newPlanObject(namespaceGVR, "", user.Name, ActionDelete))
 		}
+		objects = append(objects, newPlanObject(userGVR, "", user.Name, ActionDelete))
 	}
-	return m
+	return objects, nil
 }
-func getNamespacesList(client *kubernetes.Clientset) ([]string, error) {
 
-	nsList, err := client.CoreV1().Namespaces().List(v1.ListOptions{})
+func getRancherNamespaces(r *remover) ([]PlanObject, error) {
+	namespaces, err := getRancherNamespaceNames(r)
 	if err != nil {
 		return nil, err
 	}
-	nsNames := []string{}
-	for _, ns := range nsList.Items {
-		nsNames = append(nsNames, ns.Name)
+	objects := []PlanObject{}
+	for _, namespace := range namespaces {
+		objects = append(objects, newPlanObject(namespaceGVR, "", namespace, ActionDelete))
 	}
-	return nsNames, nil
+	return objects, nil
 }
 
-func nodesCleanup(management *config.ManagementContext) error {
+func nodesCleanup(r *remover, objects []PlanObject) error {
 	logrus.Infof("Removing machines")
-	nodes, err := getNodesList(management)
-	if err != nil {
-		return err
-	}
-	for _, node := range nodes {
-		if err := deleteNode(management, node); err != nil && !errors.IsNotFound(err) {
+	for _, obj := range objects {
+		if err := r.process(obj, func() error {
+			return deleteObject(r, obj)
+		}); err != nil {
 			return err
 		}
 	}
@@ -324,74 +686,62 @@ func nodesCleanup(management *config.ManagementContext) error {
 	return nil
 }
 
-func projectsCleanup(management *config.ManagementContext, k8sClient *kubernetes.Clientset) error {
-	logrus.Infof("Removing Projects")
-	projects, err := getProjectList(management)
-	if err != nil {
-		return err
-	}
-
-	for _, project := range projects {
-		logrus.Infof("deleting project [%s]..", project.Name)
-		if err := deleteNamespace(k8sClient, project.Name); err != nil && !errors.IsNotFound(err) {
-			return err
+// deleteWithNamespaces deletes management objects together with the namespace
+// Rancher created for each of them, namespaces are listed before their owner.
+func deleteWithNamespaces(r *remover, objects []PlanObject, kind string) error {
+	for _, obj := range objects {
+		if obj.Resource == namespaceGVR.Resource {
+			logrus.Infof("deleting %s [%s]..", kind, obj.Name)
+			if err := r.process(obj, func() error {
+				return deleteNamespaceAndWait(r, obj.Name)
+			}); err != nil {
+				return err
+			}
+			continue
 		}
-		if err := deleteProject(management, project); err != nil && !errors.IsNotFound(err) {
+		if err := r.process(obj, func() error {
+			return deleteObject(r, obj)
+		}); err != nil {
 			return err
 		}
 	}
+	return nil
+}
+
+func projectsCleanup(r *remover, objects []PlanObject) error {
+	logrus.Infof("Removing Projects")
+	if err := deleteWithNamespaces(r, objects, "project"); err != nil {
+		return err
+	}
 	logrus.Infof("Successfully removed Projects")
 	return nil
 }
 
-func clustersCleanup(management *config.ManagementContext, k8sClient *kubernetes.Clientset) error {
+func clustersCleanup(r *remover, objects []PlanObject) error {
 	logrus.Infof("Removing Clusters")
-	clusters, err := getClusterList(management)
-	if err != nil {
+	if err := deleteWithNamespaces(r, objects, "cluster"); err != nil {
 		return err
 	}
-	for _, cluster := range clusters {
-		logrus.Infof("deleting cluster [%s]..", cluster.Name)
-		if err := deleteNamespace(k8sClient, cluster.Name); err != nil && !errors.IsNotFound(err) {
-			return err
-		}
-		if err := deleteCluster(management, cluster); err != nil && !errors.IsNotFound(err) {
-			return err
-		}
-	}
 	logrus.Infof("Successfully removed Clusters")
 	return nil
 }
 
-func usersCleanup(management *config.ManagementContext, k8sClient *kubernetes.Clientset) error {
+func usersCleanup(r *remover, objects []PlanObject) error {
 	logrus.Infof("Removing Users")
-	users, err := getUserList(management)
-	if err != nil {
+	if err := deleteWithNamespaces(r, objects, "user"); err != nil {
 		return err
 	}
-	for _, user := range users {
-		logrus.Infof("deleting user [%s]..", user.Name)
-		if err := deleteNamespace(k8sClient, user.Name); err != nil && !errors.IsNotFound(err) {
-			return err
-		}
-		if err := deleteUser(management, user); err != nil && !errors.IsNotFound(err) {
-			return err
-		}
-	}
 	logrus.Infof("Successfully removed Users")
 	return nil
 }
 
-func clusterRolesCleanup(k8sClient *kubernetes.Clientset) error {
+func clusterRolesCleanup(r *remover, objects []PlanObject) error {
 	logrus.Infof("Removing ClusterRoles")
-	clusterRoles, err := getCattleClusterRolesList(k8sClient)
-	if err != nil {
-		return err
-	}
-	clusterRoles = append(clusterRoles, staticClusterRoles...)
-	for _, clusterRole := range clusterRoles {
-		logrus.Infof("deleting cluster role [%s]..", clusterRole)
-		if err := deleteClusterRole(k8sClient, clusterRole); err != nil && !errors.IsNotFound(err) {
+	for _, obj := range objects {
+		logrus.Infof("deleting cluster role [%s]..", obj.Name)
+		if err := r.process(obj, func() error {
+			return deleteObject(r, obj)
+		}); err != nil {
 			return err
 		}
 	}
@@ -399,16 +749,13 @@ func clusterRolesCleanup(k8sClient *kubernetes.Clientset) error {
 	return nil
 }
 
-func clusterRoleBindginsCleanup(k8sClient *kubernetes.Clientset) error {
+func clusterRoleBindginsCleanup(r *remover, objects []PlanObject) error {
 	logrus.Infof("Removing ClusterRoleBindings")
-	clusterRoleBindings, err := getCattleClusterRoleBindingsList(k8sClient)
-	if err != nil {
-		return err
-	}
-
-	for _, clusterRoleBinding := range clusterRoleBindings {
-		logrus.Infof("deleting cluster role binding [%s]..", clusterRoleBinding)
-		if err := deleteClusterRoleBinding(k8sClient, clusterRoleBinding); err != nil && !errors.IsNotFound(err) {
+	for _, obj := range objects {
+		logrus.Infof("deleting cluster role binding [%s]..", obj.Name)
+		if err := r.process(obj, func() error {
+			return deleteObject(r, obj)
+		}); err != nil {
 			return err
 		}
 	}
@@ -416,186 +763,156 @@ func clusterRoleBindginsCleanup(k8sClient *kubernetes.Clientset) error {
 	return nil
 }
 
-func getGroupAPIResourceList(ctx *cli.Context, apiGroup v1.APIGroup) ([]v1.APIResource, error) {
-	dc, err := clients.GetDiscoveryClient(ctx)
-	if err != nil {
-		return nil, err
-	}
-	srl, err := dc.ServerResourcesForGroupVersion(apiGroup.PreferredVersion.GroupVersion)
-	return srl.APIResources, nil
-}
-
-func isUpdateble(ar v1.APIResource) bool {
-	if strings.Contains(ar.Name, "/") {
-		return false
-	}
-	for _, v := range ar.Verbs {
-		if v == "update" {
-			return true
-		}
-	}
-	return false
-}
-
-func hasCattleMark(resource unstructured.Unstructured) bool {
-	for _, s := range resource.GetFinalizers() {
-		if strings.Contains(s, CattleLabelBase) {
-			return true
-		}
-	}
-	for k := range resource.GetLabels() {
-		if strings.Contains(k, CattleLabelBase) && !strings.Contains(k, "cattle.io/creator") {
-			return true
-		}
-	}
-	for k := range resource.GetAnnotations() {
-		if strings.Contains(k, CattleLabelBase) {
-			return true
+func rancherNamespaceCleanup(r *remover, objects []PlanObject) error {
+	for _, obj := range objects {
+		logrus.Infof("Removing Rancher Namespace [%s]", obj.Name)
+		if err := r.process(obj, func() error {
+			return deleteNamespaceAndWait(r, obj.Name)
+		}); err != nil {
+			return err
 		}
+		logrus.Infof("Successfully removed namespace [%s]", obj.Name)
 	}
-	return false
-}
-
-func removeCattleMark(resource *unstructured.Unstructured) {
-	resource.SetFinalizers(cleanupFinalizers(resource.GetFinalizers()))
-	resource.SetLabels(cleanupAnnotationsLabels(resource.GetLabels()))
-	resource.SetAnnotations(cleanupAnnotationsLabels(resource.GetAnnotations()))
+	return nil
 }
-func removeCattleAnnotationsFinalizersLabels(ctx *cli.Context) error {
-	discClient, err := clients.GetDiscoveryClient(ctx)
-	if err != nil {
-		return err
-	}
 
-	apiGroupsList, err := discClient.ServerGroups()
+func getCattleMarkedResources(r *remover) ([]PlanObject, error) {
+	apiResources, err := getAPIGroupResources(r)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	logrus.Infof("Removing Cattle Annotations, Finalizers and Labels")
-	for _, apiGroup := range apiGroupsList.Groups {
-		groupAPIResources, err := getGroupAPIResourceList(ctx, apiGroup)
-		if err != nil {
-			return err
+	gvrs := []schema.GroupVersionResource{}
+	for _, groupResources := range apiResources {
+		// objects of the cattle.io groups left in place keep their marks
+		if utils.IsCattleDomain(groupResources.group.Name) && !isRancherGroup(r, groupResources.group.Name) {
+			continue
 		}
-
-		for _, gar := range groupAPIResources {
-			grv := schema.GroupVersionResource{
-				Group:    gar.Group,
-				Version:  gar.Version,
-				Resource: gar.Name,
-			}
-			logrus.Infof("Checking API resource [%s]", gar.Name)
-			if !isUpdateble(gar) {
+		for _, gar := range groupResources.resources {
+			if !isUpdateble(gar) && !isPatchable(gar) {
 				continue
 			}
-			dynClient, err := clients.GetGroupDynamicClient(ctx, apiGroup.PreferredVersion.GroupVersion)
-			if err != nil {
-				return err
-			}
-
-			rList, err := dynClient.Resource(grv).List(v1.ListOptions{})
+			gvr, err := getGroupVersionResource(groupResources.group, gar)
 			if err != nil {
-				logrus.Warnf("Can't build dynamic client for [%s]: %v\n", gar.Name, err)
-				continue
+				return nil, err
 			}
+			gvrs = append(gvrs, gvr)
+		}
+	}
 
-			for _, r := range rList.Items {
-				if !hasCattleMark(r) {
-					continue
-				}
-				if len(r.GetNamespace()) == 0 {
-					logrus.Infof("cleaning %s", r.GetName())
-				} else {
-					logrus.Infof("cleaning %s/%s", r.GetNamespace(), r.GetName())
-				}
-				if err := utils.RetryTo(func() error {
-					ur, updateErr := dynClient.Resource(grv).Get(r.GetName(), v1.GetOptions{})
-					if updateErr != nil {
-						return updateErr
-					}
-					removeCattleMark(ur)
-					_, updateErr = dynClient.Resource(grv).Update(ur, v1.UpdateOptions{})
-					if updateErr != nil {
-						return updateErr
-					}
-					return nil
-				}); err != nil {
-					return err
+	logrus.Infof("Scanning %d API resources for Cattle Annotations, Finalizers and Labels", len(gvrs))
+	var mu sync.Mutex
+	objects := []PlanObject{}
+	scanned := startProgress("scanned API resources", len(gvrs))
+	defer scanned.finish()
+	err = forEachParallel(r.workers, len(gvrs), func(i int) error {
+		defer scanned.inc()
+		gvr := gvrs[i]
+		logrus.Debugf("Checking API resource [%s]", gvr.Resource)
+		if err := listAll(r, gvr, "", func(items []unstructured.Unstructured) error {
+			mu.Lock()
+			defer mu.Unlock()
+			for _, res := range items {
+				if r.matcher.hasCattleMark(res) {
+					objects = append(objects, newPlanObject(gvr, res.GetNamespace(), res.GetName(), ActionStripMarks))
 				}
 			}
+			return nil
+		}); err != nil {
+			r.warn("Can't list API resource [%s]: %v", gvr.Resource, err)
 		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	logrus.Infof("Removed all Cattle Annotations, Finalizers and Labels successfully")
-	return nil
+	sortPlanObjects(objects)
+	return objects, nil
 }
 
-func removeCattleAPIGroupResources(ctx *cli.Context) error {
-	discClient, err := clients.GetDiscoveryClient(ctx)
-	if err != nil {
+func removeCattleAnnotationsFinalizersLabels(r *remover, objects []PlanObject) error {
+	logrus.Infof("Removing Cattle Annotations, Finalizers and Labels")
+	// a resumed phase skips discovery, patching needs the verbs of every resource
+	if _, err := getAPIGroupResources(r); err != nil {
+		return err
+	}
+	cleaned := startProgress("cleaned objects", len(objects))
+	defer cleaned.finish()
+	if err := forEachParallel(r.workers, len(objects), func(i int) error {
+		defer cleaned.inc()
+		obj := objects[i]
+		logrus.Debugf("cleaning %s", obj.displayName())
+		return r.process(obj, func() error {
+			return stripCattleMarks(r, obj)
+		})
+	}); err != nil {
 		return err
 	}
+	logrus.Infof("Removed all Cattle Annotations, Finalizers and Labels successfully")
+	return nil
+}
 
-	apiGroupsList, err := discClient.ServerGroups()
+func getCattleAPIGroupResources(r *remover) ([]PlanObject, error) {
+	apiResources, err := getAPIGroupResources(r)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	logrus.Infof("Removing Cattle resources")
-	for _, apiGroup := range apiGroupsList.Groups {
-		if !strings.Contains(apiGroup.Name, CattleLabelBase) {
+	objects := []PlanObject{}
+	for _, groupResources := range apiResources {
+		if !isRancherGroup(r, groupResources.group.Name) {
 			continue
 		}
-		dynClient, err := clients.GetGroupDynamicClient(ctx, apiGroup.PreferredVersion.GroupVersion)
-		if err != nil {
-			return err
-		}
-		apiResourceList, err := discClient.ServerResourcesForGroupVersion(apiGroup.PreferredVersion.GroupVersion)
-		if err != nil {
-			return err
-		}
-		for _, apiResource := range apiResourceList.APIResources {
-			grv := schema.GroupVersionResource{
-				Group:    apiResource.Group,
-				Version:  apiResource.Version,
-				Resource: apiResource.Name,
+		for _, apiResource := range groupResources.resources {
+			if !isListable(apiResource) {
+				continue
 			}
-			resourcesList, err := dynClient.Resource(grv).List(v1.ListOptions{})
+			gvr, err := getGroupVersionResource(groupResources.group, apiResource)
 			if err != nil {
-				logrus.Warnf("Can't build dynamic client for [%s]: %v\n", apiResource.Name, err)
-				continue
+				return nil, err
 			}
-			for _, resource := range resourcesList.Items {
-				if len(resource.GetNamespace()) == 0 {
-					logrus.Infof("removing %s", resource.GetName())
-				} else {
-					logrus.Infof("removing %s/%s", resource.GetNamespace(), resource.GetName())
-				}
-				if err := dynClient.Resource(grv).Delete(resource.GetName(), &v1.DeleteOptions{}); err != nil {
-					return err
+			if err := listAll(r, gvr, "", func(items []unstructured.Unstructured) error {
+				for _, resource := range items {
+					objects = append(objects, newPlanObject(gvr, resource.GetNamespace(), resource.GetName(), ActionDelete))
 				}
+				return nil
+			}); err != nil {
+				r.warn("Can't list API resource [%s]: %v", apiResource.Name, err)
 			}
 		}
+	}
+	return objects, nil
+}
 
+func removeCattleAPIGroupResources(r *remover, objects []PlanObject) error {
+	logrus.Infof("Removing Cattle resources")
+	for _, obj := range objects {
+		logrus.Infof("removing %s", obj.displayName())
+		if err := r.process(obj, func() error {
+			return deleteObject(r, obj)
+		}); err != nil {
+			return err
+		}
 	}
-	logrus.Infof("Removed all Cattle resources succuessfully")
+	logrus.Infof("Removed all Cattle resources successfully")
 	return nil
 }
 
-func removeCattleCRDs(ctx *cli.Context) error {
-	apiExtClient, err := clients.GetAPIExtensionsClient(ctx)
-	if err != nil {
-		return err
-	}
-	crdList, err := apiExtClient.ApiextensionsV1beta1().CustomResourceDefinitions().List(v1.ListOptions{})
-	if err != nil {
-		return err
-	}
-	for _, crd := range crdList.Items {
-		if strings.Contains(crd.Name, CattleLabelBase) {
-			if err := apiExtClient.ApiextensionsV1beta1().CustomResourceDefinitions().Delete(crd.Name, &v1.DeleteOptions{}); err != nil {
-				return err
-			}
+// getCattleCRDs lists CRDs through the apiextensions version the cluster
+// prefers, v1beta1 isn't served by newer clusters.
+func getCattleCRDs(r *remover) ([]PlanObject, error) {
+	return findObjects(r, "apiextensions.k8s.io", "customresourcedefinitions", ActionDelete, func(crd unstructured.Unstructured) bool {
+		group, _, _ := unstructured.NestedString(crd.Object, "spec", "group")
+		return isRancherGroup(r, group)
+	})
+}
+
+func removeCattleCRDs(r *remover, objects []PlanObject) error {
+	for _, obj := range objects {
+		if err := r.process(obj, func() error {
+			return deleteObject(r, obj)
+		}); err != nil {
+			return err
 		}
 	}
-	logrus.Infof("Removed all Cattle CRDs succuessfully")
+	logrus.Infof("Removed all Cattle CRDs successfully")
 	return nil
 }
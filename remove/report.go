@@ -0,0 +1,194 @@
+package remove
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+const (
+	OutcomeDeleted = "deleted"
+	OutcomePatched = "patched"
+	OutcomeSkipped = "skipped"
+	OutcomeFailed  = "failed"
+
+	ResultSuccess = "success"
+	ResultPartial = "partial"
+	ResultAborted = "aborted"
+
+	// exit codes of remove, other errors exit with 1
+	ExitSuccess = 0
+	ExitPartial = 2
+	ExitAborted = 3
+)
+
+type ReportObject struct {
+	Phase     string    `json:"phase"`
+	Group     string    `json:"group,omitempty"`
+	Version   string    `json:"version"`
+	Resource  string    `json:"resource"`
+	Namespace string    `json:"namespace,omitempty"`
+	Name      string    `json:"name"`
+	Outcome   string    `json:"outcome"`
+	Time      time.Time `json:"time"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// Report lists the outcome of every object the removal acted on, it is
+// written as JSON, or YAML when the file name ends with .yaml or .yml.
+type Report struct {
+	Namespace  string          `json:"namespace"`
+	Downstream bool            `json:"downstream,omitempty"`
+	Result     string          `json:"result"`
+	StartedAt  time.Time       `json:"startedAt"`
+	FinishedAt time.Time       `json:"finishedAt"`
+	Warnings   []string        `json:"warnings,omitempty"`
+	Decisions  []PhaseDecision `json:"decisions,omitempty"`
+	Objects    []ReportObject  `json:"objects"`
+
+	path string
+	mu   sync.Mutex
+	// position of each object in Objects, a retried object keeps its last outcome
+	index map[string]int
+}
+
+func newReport(path, namespace string, downstream bool) *Report {
+	return &Report{
+		Namespace:  namespace,
+		Downstream: downstream,
+		StartedAt:  time.Now().UTC(),
+		Objects:    []ReportObject{},
+		path:       path,
+		index:      map[string]int{},
+	}
+}
+
+func (rp *Report) record(phase string, obj PlanObject, outcome string, err error) {
+	reportObject := ReportObject{
+		Phase:     phase,
+		Group:     obj.Group,
+		Version:   obj.Version,
+		Resource:  obj.Resource,
+		Namespace: obj.Namespace,
+		Name:      obj.Name,
+		Outcome:   outcome,
+		Time:      time.Now().UTC(),
+	}
+	if err != nil {
+		reportObject.Error = err.Error()
+	}
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	key := phase + "/" + obj.key()
+	if i, ok := rp.index[key]; ok {
+		rp.Objects[i] = reportObject
+		return
+	}
+	rp.index[key] = len(rp.Objects)
+	rp.Objects = append(rp.Objects, reportObject)
+}
+
+func (rp *Report) recordDecision(phase, decision, summary string) {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	rp.Decisions = append(rp.Decisions, PhaseDecision{
+		Phase:    phase,
+		Decision: decision,
+		Summary:  summary,
+		Time:     time.Now().UTC(),
+	})
+}
+
+func (rp *Report) counts() (changed, failed int) {
+	for _, obj := range rp.Objects {
+		switch obj.Outcome {
+		case OutcomeDeleted, OutcomePatched:
+			changed++
+		case OutcomeFailed:
+			failed++
+		}
+	}
+	return
+}
+
+// result returns the result of a removal stopped by err.
+func (rp *Report) result(err error, warnings []string) string {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	changed, failed := rp.counts()
+	switch {
+	case err == nil && failed == 0 && len(warnings) == 0:
+		return ResultSuccess
+	case err == errRemovalAborted, err != nil && changed == 0:
+		return ResultAborted
+	}
+	return ResultPartial
+}
+
+// finish sets the result of the removal from the error that stopped it and
+// writes the report, the returned error carries the exit code of the result.
+func (rp *Report) finish(err error, warnings []string) error {
+	result := rp.result(err, warnings)
+	rp.mu.Lock()
+	rp.Result = result
+	rp.Warnings = warnings
+	rp.mu.Unlock()
+	if writeErr := rp.write(); writeErr != nil {
+		logrus.Errorf("failed to write removal report: %v", writeErr)
+	}
+
+	switch result {
+	case ResultSuccess:
+		return nil
+	case ResultAborted:
+		return cli.NewExitError(fmt.Sprintf("removal aborted: %v", err), ExitAborted)
+	}
+	if err == nil {
+		err = fmt.Errorf("%d warnings, objects may be left behind", len(warnings))
+	}
+	return cli.NewExitError(fmt.Sprintf("removal finished partially: %v", err), ExitPartial)
+}
+
+// abort writes the report of an interrupted removal.
+func (rp *Report) abort(warnings []string) {
+	rp.mu.Lock()
+	rp.Result = ResultAborted
+	rp.Warnings = warnings
+	rp.mu.Unlock()
+	if err := rp.write(); err != nil {
+		logrus.Errorf("failed to write removal report: %v", err)
+	}
+}
+
+func (rp *Report) write() error {
+	if len(rp.path) == 0 {
+		return nil
+	}
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	rp.FinishedAt = time.Now().UTC()
+	var data []byte
+	var err error
+	switch strings.ToLower(filepath.Ext(rp.path)) {
+	case ".yaml", ".yml":
+		data, err = yaml.Marshal(rp)
+	default:
+		data, err = json.MarshalIndent(rp, "", "  ")
+	}
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(rp.path, data, 0600); err != nil {
+		return err
+	}
+	logrus.Infof("Removal report written to [%s]", rp.path)
+	return nil
+}
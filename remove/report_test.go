@@ -0,0 +1,61 @@
+package remove
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestReportResult(t *testing.T) {
+	tests := []struct {
+		name     string
+		outcomes []string
+		err      error
+		warnings []string
+		want     string
+	}{
+		{
+			name:     "clean run",
+			outcomes: []string{OutcomeDeleted, OutcomePatched, OutcomeSkipped},
+			want:     ResultSuccess,
+		},
+		{
+			name:     "warnings only",
+			outcomes: []string{OutcomeDeleted},
+			warnings: []string{"some API groups are not available"},
+			want:     ResultPartial,
+		},
+		{
+			name:     "failed objects",
+			outcomes: []string{OutcomeDeleted, OutcomeFailed},
+			want:     ResultPartial,
+		},
+		{
+			name:     "failed phase after changes",
+			outcomes: []string{OutcomeDeleted},
+			err:      fmt.Errorf("phase failed"),
+			want:     ResultPartial,
+		},
+		{
+			name: "failed before any change",
+			err:  fmt.Errorf("can't connect"),
+			want: ResultAborted,
+		},
+		{
+			name:     "aborted by the operator",
+			outcomes: []string{OutcomeDeleted},
+			err:      errRemovalAborted,
+			want:     ResultAborted,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rp := newReport("", "cattle-system", false)
+			for i, outcome := range tt.outcomes {
+				rp.record("namespace", PlanObject{Resource: "configmaps", Name: fmt.Sprintf("cm-%d", i)}, outcome, nil)
+			}
+			if got := rp.result(tt.err, tt.warnings); got != tt.want {
+				t.Errorf("result() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,204 @@
+package remove
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/urfave/cli"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Profile selects the phases a removal runs, the keys it strips and how
+// phases delete objects, it can be loaded from a file with --profile and the
+// matching flags override it.
+type Profile struct {
+	Include   []string                `yaml:"include,omitempty"`
+	Exclude   []string                `yaml:"exclude,omitempty"`
+	KeepKeys  []string                `yaml:"keepKeys,omitempty"`
+	StripKeys []string                `yaml:"stripKeys,omitempty"`
+	Phases    map[string]PhaseOptions `yaml:"phases,omitempty"`
+}
+
+type phaseRequirement struct {
+	phases []string
+	reason string
+}
+
+// phaseRequirements lists the phases that have to run along with a phase
+// for the removal to leave the cluster in a consistent state.
+var phaseRequirements = map[string]phaseRequirement{
+	"deployment": {
+		phases: []string{"webhooks"},
+		reason: "webhooks and APIServices served by the Rancher deployment block requests across the cluster once it's gone",
+	},
+	"helm-releases": {
+		phases: []string{"webhooks"},
+		reason: "webhooks served by the released deployments block requests across the cluster once they're gone",
+	},
+	"cattle-marks": {
+		phases: []string{"deployment"},
+		reason: "a running Rancher deployment puts the marks back",
+	},
+	"projects": {
+		phases: []string{"deployment", "cattle-marks"},
+		reason: "projects are stuck on Rancher finalizers while Rancher runs or its finalizers are kept",
+	},
+	"nodes": {
+		phases: []string{"deployment", "cattle-marks"},
+		reason: "nodes are stuck on Rancher finalizers while Rancher runs or its finalizers are kept",
+	},
+	"clusters": {
+		phases: []string{"deployment", "cattle-marks"},
+		reason: "clusters are stuck on Rancher finalizers while Rancher runs or its finalizers are kept",
+	},
+	"users": {
+		phases: []string{"deployment", "cattle-marks"},
+		reason: "users are stuck on Rancher finalizers while Rancher runs or its finalizers are kept",
+	},
+	"cattle-resources": {
+		phases: []string{"projects", "nodes", "clusters", "users"},
+		reason: "it deletes every cattle.io object, including the projects, nodes, clusters and users but not their namespaces",
+	},
+	"crds": {
+		phases: []string{"cattle-resources"},
+		reason: "deleting a CRD deletes all of its instances",
+	},
+	"namespace": {
+		phases: []string{"deployment"},
+		reason: "deleting the Rancher namespace deletes the Rancher deployment",
+	},
+}
+
+// downstreamPhaseRequirements are the phaseRequirements of a downstream removal.
+var downstreamPhaseRequirements = map[string]phaseRequirement{
+	"agents": {
+		phases: []string{"webhooks"},
+		reason: "webhooks and APIServices served by the Rancher agents block requests across the cluster once they're gone",
+	},
+	"helm-releases": {
+		phases: []string{"webhooks"},
+		reason: "webhooks served by the released deployments block requests across the cluster once they're gone",
+	},
+	"cattle-marks": {
+		phases: []string{"agents"},
+		reason: "running Rancher agents put the marks back",
+	},
+	"cattle-resources": {
+		phases: []string{"agents"},
+		reason: "running Rancher agents recreate them",
+	},
+	"crds": {
+		phases: []string{"cattle-resources"},
+		reason: "deleting a CRD deletes all of its instances",
+	},
+	"namespaces": {
+		phases: []string{"agents"},
+		reason: "deleting the Rancher namespace deletes the Rancher agents",
+	},
+}
+
+func loadProfile(fileName string) (*Profile, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("can not read removal profile: %v", err)
+	}
+	profile := &Profile{}
+	if err := yaml.UnmarshalStrict(data, profile); err != nil {
+		return nil, fmt.Errorf("failed to parse removal profile [%s]: %v", fileName, err)
+	}
+	return profile, nil
+}
+
+func splitList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) != 0 {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func getProfile(ctx *cli.Context) (*Profile, error) {
+	profile := &Profile{}
+	if profileFile := ctx.String("profile"); len(profileFile) != 0 {
+		var err error
+		if profile, err = loadProfile(profileFile); err != nil {
+			return nil, err
+		}
+	}
+	if include := ctx.String("include"); len(include) != 0 {
+		profile.Include = splitList(include)
+	}
+	if exclude := ctx.String("exclude"); len(exclude) != 0 {
+		profile.Exclude = splitList(exclude)
+	}
+	if keepKeys := ctx.String("keep-keys"); len(keepKeys) != 0 {
+		profile.KeepKeys = splitList(keepKeys)
+	}
+	if stripKeys := ctx.String("strip-keys"); len(stripKeys) != 0 {
+		profile.StripKeys = splitList(stripKeys)
+	}
+	return profile, nil
+}
+
+// selectPhases returns the phases to run, all of them unless the profile
+// includes only some, minus the excluded ones.
+func selectPhases(phases []phase, requirements map[string]phaseRequirement, profile *Profile) (map[string]bool, error) {
+	known := map[string]bool{}
+	for _, p := range phases {
+		known[p.name] = true
+	}
+	for _, name := range append(append([]string{}, profile.Include...), profile.Exclude...) {
+		if !known[name] {
+			return nil, fmt.Errorf("unknown removal phase [%s], valid phases are: %s", name, strings.Join(phaseNames(phases), ", "))
+		}
+	}
+	selected := map[string]bool{}
+	if len(profile.Include) == 0 {
+		for name := range known {
+			selected[name] = true
+		}
+	}
+	for _, name := range profile.Include {
+		selected[name] = true
+	}
+	for _, name := range profile.Exclude {
+		delete(selected, name)
+	}
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("no removal phase selected")
+	}
+	if err := validateSelectedPhases(phases, requirements, selected); err != nil {
+		return nil, err
+	}
+	return selected, nil
+}
+
+func validateSelectedPhases(phases []phase, requirements map[string]phaseRequirement, selected map[string]bool) error {
+	for _, p := range phases {
+		if !selected[p.name] {
+			continue
+		}
+		requirement, ok := requirements[p.name]
+		if !ok {
+			continue
+		}
+		for _, required := range requirement.phases {
+			if !selected[required] {
+				return fmt.Errorf("phase [%s] can't run without phase [%s]: %s", p.name, required, requirement.reason)
+			}
+		}
+	}
+	return nil
+}
+
+func phaseNames(phases []phase) []string {
+	names := []string{}
+	for _, p := range phases {
+		names = append(names, p.name)
+	}
+	return names
+}
@@ -0,0 +1,93 @@
+package remove
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestSelectPhases(t *testing.T) {
+	tests := []struct {
+		name       string
+		downstream bool
+		profile    Profile
+		want       []string
+		wantErr    bool
+	}{
+		{
+			name:    "everything",
+			profile: Profile{},
+			want:    phaseNames(removalPhases),
+		},
+		{
+			name:    "include with requirements",
+			profile: Profile{Include: []string{"webhooks", "deployment"}},
+			want:    []string{"deployment", "webhooks"},
+		},
+		{
+			name:    "include without requirement",
+			profile: Profile{Include: []string{"deployment"}},
+			wantErr: true,
+		},
+		{
+			name:    "exclude a leaf",
+			profile: Profile{Exclude: []string{"namespace", "crds"}},
+			want:    []string{"cattle-marks", "cattle-resources", "cluster-role-bindings", "cluster-roles", "clusters", "deployment", "helm-releases", "nodes", "projects", "users", "webhooks"},
+		},
+		{
+			name:    "exclude a requirement",
+			profile: Profile{Exclude: []string{"cattle-marks"}},
+			wantErr: true,
+		},
+		{
+			name:    "unknown phase",
+			profile: Profile{Include: []string{"everything"}},
+			wantErr: true,
+		},
+		{
+			name:    "nothing left",
+			profile: Profile{Include: []string{"webhooks"}, Exclude: []string{"webhooks"}},
+			wantErr: true,
+		},
+		{
+			name:       "downstream phase names",
+			downstream: true,
+			profile:    Profile{Include: []string{"webhooks", "agents", "namespaces"}},
+			want:       []string{"agents", "namespaces", "webhooks"},
+		},
+		{
+			name:       "management phase downstream",
+			downstream: true,
+			profile:    Profile{Include: []string{"namespace"}},
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			phases, requirements := removalPhases, phaseRequirements
+			if tt.downstream {
+				phases, requirements = downstreamPhases, downstreamPhaseRequirements
+			}
+			selected, err := selectPhases(phases, requirements, &tt.profile)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected an error, selected %v", selected)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := []string{}
+			for name := range selected {
+				got = append(got, name)
+			}
+			sort.Strings(got)
+			want := append([]string{}, tt.want...)
+			sort.Strings(want)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("selectPhases() = %v, want %v", got, want)
+			}
+		})
+	}
+}
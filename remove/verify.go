@@ -0,0 +1,165 @@
+package remove
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const ActionResidue = "residue"
+
+var VerifyFlags = append([]cli.Flag{DownstreamFlag}, scanFlags...)
+
+type residueCheck struct {
+	name string
+	find func(r *remover) ([]PlanObject, error)
+}
+
+type residue struct {
+	check string
+	obj   PlanObject
+}
+
+// residueChecks runs the discovery of every removal phase followed by checks
+// for the leftovers the removal phases don't cover.
+func residueChecks(phases []phase) []residueCheck {
+	checks := []residueCheck{}
+	for _, p := range phases {
+		checks = append(checks, residueCheck{name: p.name, find: p.discover})
+	}
+	return append(checks,
+		residueCheck{name: "terminating-namespaces", find: getTerminatingNamespaces},
+		residueCheck{name: "service-accounts", find: getRancherServiceAccounts},
+		residueCheck{name: "pod-security-policies", find: getRancherPodSecurityPolicies},
+		residueCheck{name: "secrets", find: getCattleLabelledSecrets},
+	)
+}
+
+func DoVerify(ctx *cli.Context) error {
+	r, err := newRemover(ctx)
+	if err != nil {
+		return err
+	}
+	target := "Rancher management plane"
+	if r.downstream {
+		target = "Rancher agents"
+	}
+	logrus.Infof("Verifying removal of %s in namespace: [%s]", target, ctx.String("namespace"))
+	residues, failedChecks := findResidue(r)
+	if err := printResidue(os.Stdout, residues); err != nil {
+		return err
+	}
+	if len(failedChecks) != 0 {
+		return fmt.Errorf("verification is incomplete, checks %v failed", failedChecks)
+	}
+	if warnings := r.getWarnings(); len(warnings) != 0 {
+		return fmt.Errorf("verification is incomplete, %d API groups or resources couldn't be scanned", len(warnings))
+	}
+	if len(residues) != 0 {
+		return fmt.Errorf("found %d leftover Rancher objects", len(residues))
+	}
+	logrus.Infof("No Rancher leftovers found")
+	return nil
+}
+
+func findResidue(r *remover) ([]residue, []string) {
+	residues := []residue{}
+	failedChecks := []string{}
+	found := map[string]bool{}
+	for _, check := range residueChecks(r.phases) {
+		logrus.Infof("Checking [%s]", check.name)
+		objects, err := check.find(r)
+		if err != nil {
+			// the management API is gone along with the Rancher CRDs
+			if errors.IsNotFound(err) {
+				continue
+			}
+			logrus.Warnf("Check [%s] failed: %v", check.name, err)
+			failedChecks = append(failedChecks, check.name)
+			continue
+		}
+		for _, obj := range objects {
+			if found[obj.key()] {
+				continue
+			}
+			found[obj.key()] = true
+			residues = append(residues, residue{check: check.name, obj: obj})
+		}
+	}
+	return residues, failedChecks
+}
+
+func printResidue(w io.Writer, residues []residue) error {
+	byKind := map[string][]residue{}
+	kinds := []string{}
+	for _, res := range residues {
+		kind := res.obj.GVRString()
+		if _, ok := byKind[kind]; !ok {
+			kinds = append(kinds, kind)
+		}
+		byKind[kind] = append(byKind[kind], res)
+	}
+	sort.Strings(kinds)
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "Found %d leftover Rancher objects\n", len(residues))
+	for _, kind := range kinds {
+		fmt.Fprintf(tw, "\n%s (%d)\n", kind, len(byKind[kind]))
+		for _, res := range byKind[kind] {
+			fmt.Fprintf(tw, "  %s\t%s\n", res.obj.displayName(), res.check)
+		}
+	}
+	return tw.Flush()
+}
+
+func getTerminatingNamespaces(r *remover) ([]PlanObject, error) {
+	return findObjects(r, "", "namespaces", ActionResidue, func(obj unstructured.Unstructured) bool {
+		phase, _, _ := unstructured.NestedString(obj.Object, "status", "phase")
+		return phase == namespaceTerminating
+	})
+}
+
+// name prefixes of leftover objects reported by verify
+var rancherNamePrefixes = []string{
+	"rancher",
+	"cattle",
+}
+
+func isRancherName(name string) bool {
+	for _, prefix := range rancherNamePrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func isRancherOwned(r *remover, obj unstructured.Unstructured) bool {
+	_, hasCreator := obj.GetLabels()[cattleCreatorLabel]
+	return hasCreator || r.matcher.hasCattleMark(obj)
+}
+
+func getRancherServiceAccounts(r *remover) ([]PlanObject, error) {
+	return findObjects(r, "", "serviceaccounts", ActionResidue, func(obj unstructured.Unstructured) bool {
+		return obj.GetNamespace() == r.namespace || isRancherName(obj.GetName()) || isRancherOwned(r, obj)
+	})
+}
+
+func getRancherPodSecurityPolicies(r *remover) ([]PlanObject, error) {
+	return findObjects(r, "policy", "podsecuritypolicies", ActionResidue, func(obj unstructured.Unstructured) bool {
+		return isRancherOwned(r, obj)
+	})
+}
+
+func getCattleLabelledSecrets(r *remover) ([]PlanObject, error) {
+	return findObjects(r, "", "secrets", ActionResidue, func(obj unstructured.Unstructured) bool {
+		return isRancherOwned(r, obj)
+	})
+}
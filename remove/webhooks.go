@@ -0,0 +1,108 @@
+package remove
+
+import (
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// webhook configurations Rancher registers, whichever namespace their service is in
+var rancherWebhookNames = map[string]bool{
+	"rancher.cattle.io": true,
+}
+
+// APIServices Rancher registers, whichever namespace their service is in
+var rancherAPIServiceNames = map[string]bool{
+	"v1.ext.cattle.io": true,
+}
+
+// isRancherServiceNamespace matches --namespace and the Rancher companion
+// namespaces, the only namespaces whose services back Rancher webhooks.
+func isRancherServiceNamespace(r *remover, namespace string) bool {
+	if namespace == r.namespace {
+		return true
+	}
+	for _, name := range rancherNamespaces {
+		if namespace == name {
+			return true
+		}
+	}
+	return false
+}
+
+// isRancherWebhookConfiguration matches the Rancher webhook configurations by
+// name, and the ones calling a service in the Rancher namespaces.
+func isRancherWebhookConfiguration(r *remover, obj unstructured.Unstructured) bool {
+	if rancherWebhookNames[obj.GetName()] {
+		return true
+	}
+	webhooks, _, _ := unstructured.NestedSlice(obj.Object, "webhooks")
+	for _, w := range webhooks {
+		webhook, ok := w.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		namespace, _, _ := unstructured.NestedString(webhook, "clientConfig", "service", "namespace")
+		if isRancherServiceNamespace(r, namespace) {
+			return true
+		}
+	}
+	return false
+}
+
+// isRancherAPIService matches the Rancher APIServices by name, and the ones
+// backed by a service in the Rancher namespaces.
+func isRancherAPIService(r *remover, obj unstructured.Unstructured) bool {
+	if rancherAPIServiceNames[obj.GetName()] {
+		return true
+	}
+	namespace, _, _ := unstructured.NestedString(obj.Object, "spec", "service", "namespace")
+	return isRancherServiceNamespace(r, namespace)
+}
+
+func getRancherWebhooks(r *remover) ([]PlanObject, error) {
+	objects := []PlanObject{}
+	for _, resource := range []string{"validatingwebhookconfigurations", "mutatingwebhookconfigurations"} {
+		webhooks, err := findObjects(r, "admissionregistration.k8s.io", resource, ActionDelete, func(obj unstructured.Unstructured) bool {
+			return isRancherWebhookConfiguration(r, obj)
+		})
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, webhooks...)
+	}
+	return objects, nil
+}
+
+func getRancherAPIServices(r *remover) ([]PlanObject, error) {
+	return findObjects(r, "apiregistration.k8s.io", "apiservices", ActionDelete, func(obj unstructured.Unstructured) bool {
+		return isRancherAPIService(r, obj)
+	})
+}
+
+func getRancherWebhooksAndAPIServices(r *remover) ([]PlanObject, error) {
+	webhooks, err := getRancherWebhooks(r)
+	if err != nil {
+		return nil, err
+	}
+	apiServices, err := getRancherAPIServices(r)
+	if err != nil {
+		return nil, err
+	}
+	return append(webhooks, apiServices...), nil
+}
+
+// removeRancherWebhooks runs before the Rancher deployment is deleted, webhooks
+// and APIServices left without their service block requests across the cluster.
+func removeRancherWebhooks(r *remover, objects []PlanObject) error {
+	logrus.Infof("Removing Rancher admission webhooks and APIServices")
+	for _, obj := range objects {
+		logrus.Infof("deleting %s [%s]..", obj.Resource, obj.Name)
+		if err := r.process(obj, func() error {
+			return deleteObject(r, obj)
+		}); err != nil {
+			return err
+		}
+	}
+	logrus.Infof("Successfully removed Rancher admission webhooks and APIServices")
+	return nil
+}
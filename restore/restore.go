@@ -0,0 +1,330 @@
+package restore
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/rancher/system-tools/backup"
+	"github.com/rancher/system-tools/clients"
+	"github.com/rancher/system-tools/utils"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+)
+
+const (
+	PolicySkip      = "skip"
+	PolicyOverwrite = "overwrite"
+
+	DefaultCRDEstablishedWait = 60 * time.Second
+)
+
+var RestoreFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:   "kubeconfig,c",
+		EnvVar: "KUBECONFIG",
+		Usage:  "kubeconfig absolute path",
+	},
+	cli.StringFlag{
+		Name:  "backup,b",
+		Usage: "backup archive written by remove",
+	},
+	cli.StringFlag{
+		Name:  "policy",
+		Usage: "what to do with objects that already exist: skip or overwrite",
+		Value: PolicySkip,
+	},
+}
+
+// metadata set by the server that can't be sent back on create
+var serverMetadataFields = []string{
+	"resourceVersion",
+	"uid",
+	"selfLink",
+	"creationTimestamp",
+	"generation",
+	"deletionTimestamp",
+	"deletionGracePeriodSeconds",
+}
+
+// ownerRefs maps the UIDs of the backed up objects to the UIDs of the objects
+// restored from them, and lists the restored objects that had owners.
+type ownerRefs struct {
+	uids  map[types.UID]types.UID
+	owned []backup.Entry
+}
+
+func DoRestore(ctx *cli.Context) error {
+	backupFile := ctx.String("backup")
+	if len(backupFile) == 0 {
+		return fmt.Errorf("Please use option -b to set the backup archive")
+	}
+	policy := ctx.String("policy")
+	if policy != PolicySkip && policy != PolicyOverwrite {
+		return fmt.Errorf("unsupported policy [%s], use %s or %s", policy, PolicySkip, PolicyOverwrite)
+	}
+	archive, err := backup.Read(backupFile)
+	if err != nil {
+		return err
+	}
+	logrus.Infof("Restoring %d entries from backup [%s] created at [%s] by version [%s]",
+		len(archive.Manifest.Entries), backupFile, archive.Manifest.CreatedAt.Format(time.RFC3339), archive.Manifest.ToolVersion)
+
+	dynClient, err := clients.GetDynamicClient(ctx)
+	if err != nil {
+		return err
+	}
+	crds, namespaces, cattleObjects, objects, marks := sortEntries(archive.Manifest.Entries)
+	refs := &ownerRefs{uids: map[types.UID]types.UID{}}
+
+	logrus.Infof("Restoring CRDs")
+	for _, entry := range crds {
+		if err := restoreObject(dynClient, archive, entry, policy, refs); err != nil {
+			return err
+		}
+		if err := waitForCRDEstablished(dynClient, entry); err != nil {
+			return err
+		}
+	}
+	logrus.Infof("Restoring Namespaces")
+	for _, entry := range namespaces {
+		if err := restoreObject(dynClient, archive, entry, policy, refs); err != nil {
+			return err
+		}
+	}
+	logrus.Infof("Restoring Cattle resources")
+	for _, entry := range cattleObjects {
+		if err := restoreObject(dynClient, archive, entry, policy, refs); err != nil {
+			return err
+		}
+	}
+	logrus.Infof("Restoring remaining objects")
+	for _, entry := range objects {
+		if err := restoreObject(dynClient, archive, entry, policy, refs); err != nil {
+			return err
+		}
+	}
+	logrus.Infof("Restoring Owner References")
+	for _, entry := range refs.owned {
+		if err := restoreOwnerReferences(dynClient, archive, entry, refs); err != nil {
+			return err
+		}
+	}
+	logrus.Infof("Restoring Cattle Annotations, Finalizers and Labels")
+	for _, entry := range marks {
+		if err := restoreMarks(dynClient, archive, entry); err != nil {
+			return err
+		}
+	}
+	logrus.Infof("Backup [%s] restored successfully", backupFile)
+	return nil
+}
+
+// sortEntries splits the manifest entries in the order they need to be restored in,
+// each group depends on the ones before it.
+func sortEntries(entries []backup.Entry) (crds, namespaces, cattleObjects, objects, marks []backup.Entry) {
+	for _, entry := range entries {
+		switch {
+		case entry.Type == backup.EntryMarks:
+			marks = append(marks, entry)
+		case entry.Group == "apiextensions.k8s.io" && entry.Resource == "customresourcedefinitions":
+			crds = append(crds, entry)
+		case entry.Group == "" && entry.Resource == "namespaces":
+			namespaces = append(namespaces, entry)
+		case utils.IsCattleDomain(entry.Group):
+			cattleObjects = append(cattleObjects, entry)
+		default:
+			objects = append(objects, entry)
+		}
+	}
+	return
+}
+
+func displayName(entry backup.Entry) string {
+	if len(entry.Namespace) == 0 {
+		return entry.Name
+	}
+	return fmt.Sprintf("%s/%s", entry.Namespace, entry.Name)
+}
+
+// restoreObject creates or overwrites an object without its owner references,
+// the owners get new UIDs when they are restored so the references are only
+// set by restoreOwnerReferences once every object is back.
+func restoreObject(dynClient dynamic.Interface, archive *backup.Archive, entry backup.Entry, policy string, refs *ownerRefs) error {
+	obj, err := archive.Object(entry)
+	if err != nil {
+		return err
+	}
+	uid := obj.GetUID()
+	owned := len(obj.GetOwnerReferences()) != 0
+	for _, field := range serverMetadataFields {
+		unstructured.RemoveNestedField(obj.Object, "metadata", field)
+	}
+	unstructured.RemoveNestedField(obj.Object, "metadata", "ownerReferences")
+	resourceClient := dynClient.Resource(entry.GVR()).Namespace(entry.Namespace)
+
+	existing, err := resourceClient.Get(entry.Name, v1.GetOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	if err == nil {
+		if policy == PolicySkip {
+			logrus.Infof("skipping existing %s [%s]", entry.Kind, displayName(entry))
+			refs.add(entry, uid, existing.GetUID(), false)
+			return nil
+		}
+		logrus.Infof("overwriting %s [%s]", entry.Kind, displayName(entry))
+		err = utils.RetryTo(func() error {
+			current, err := resourceClient.Get(entry.Name, v1.GetOptions{})
+			if err != nil {
+				return err
+			}
+			obj.SetResourceVersion(current.GetResourceVersion())
+			existing, err = resourceClient.Update(obj, v1.UpdateOptions{})
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		refs.add(entry, uid, existing.GetUID(), owned)
+		return nil
+	}
+	logrus.Infof("restoring %s [%s]", entry.Kind, displayName(entry))
+	created, err := resourceClient.Create(obj, v1.CreateOptions{})
+	if errors.IsAlreadyExists(err) {
+		created, err = resourceClient.Get(entry.Name, v1.GetOptions{})
+	}
+	if err != nil {
+		return fmt.Errorf("failed to restore %s [%s]: %v", entry.Kind, displayName(entry), err)
+	}
+	refs.add(entry, uid, created.GetUID(), owned)
+	return nil
+}
+
+func (r *ownerRefs) add(entry backup.Entry, backupUID, uid types.UID, owned bool) {
+	r.uids[backupUID] = uid
+	if owned {
+		r.owned = append(r.owned, entry)
+	}
+}
+
+// restoreOwnerReferences sets the owner references of a restored object, with
+// the UIDs of the restored owners. Owners that weren't in the backup were
+// never removed and keep their UID.
+func restoreOwnerReferences(dynClient dynamic.Interface, archive *backup.Archive, entry backup.Entry, refs *ownerRefs) error {
+	original, err := archive.Object(entry)
+	if err != nil {
+		return err
+	}
+	owners := original.GetOwnerReferences()
+	for i := range owners {
+		if uid, ok := refs.uids[owners[i].UID]; ok {
+			owners[i].UID = uid
+		}
+	}
+	resourceClient := dynClient.Resource(entry.GVR()).Namespace(entry.Namespace)
+	logrus.Infof("restoring owner references of %s [%s]", entry.Kind, displayName(entry))
+	err = utils.RetryTo(func() error {
+		obj, err := resourceClient.Get(entry.Name, v1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		obj.SetOwnerReferences(owners)
+		_, err = resourceClient.Update(obj, v1.UpdateOptions{})
+		return err
+	})
+	if errors.IsNotFound(err) {
+		logrus.Warnf("%s [%s] no longer exists, can't restore its owner references", entry.Kind, displayName(entry))
+		return nil
+	}
+	return err
+}
+
+// restoreMarks puts back the labels, annotations and finalizers the removal
+// stripped, values set on the object since then are kept.
+func restoreMarks(dynClient dynamic.Interface, archive *backup.Archive, entry backup.Entry) error {
+	marks, err := archive.Object(entry)
+	if err != nil {
+		return err
+	}
+	resourceClient := dynClient.Resource(entry.GVR()).Namespace(entry.Namespace)
+	logrus.Infof("restoring marks on %s [%s]", entry.Kind, displayName(entry))
+	err = utils.RetryTo(func() error {
+		obj, err := resourceClient.Get(entry.Name, v1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		obj.SetLabels(mergeMaps(obj.GetLabels(), marks.GetLabels()))
+		obj.SetAnnotations(mergeMaps(obj.GetAnnotations(), marks.GetAnnotations()))
+		obj.SetFinalizers(mergeFinalizers(obj.GetFinalizers(), marks.GetFinalizers()))
+		_, err = resourceClient.Update(obj, v1.UpdateOptions{})
+		return err
+	})
+	if errors.IsNotFound(err) {
+		logrus.Warnf("%s [%s] no longer exists, can't restore its marks", entry.Kind, displayName(entry))
+		return nil
+	}
+	return err
+}
+
+func mergeMaps(current, original map[string]string) map[string]string {
+	if current == nil {
+		current = map[string]string{}
+	}
+	for k, v := range original {
+		if _, ok := current[k]; !ok {
+			current[k] = v
+		}
+	}
+	return current
+}
+
+func mergeFinalizers(current, original []string) []string {
+	existing := map[string]bool{}
+	for _, f := range current {
+		existing[f] = true
+	}
+	for _, f := range original {
+		if !existing[f] {
+			current = append(current, f)
+		}
+	}
+	return current
+}
+
+func waitForCRDEstablished(dynClient dynamic.Interface, entry backup.Entry) error {
+	logrus.Infof("waiting for CRD [%s] to be established..", entry.Name)
+	timeout := time.After(DefaultCRDEstablishedWait)
+	for {
+		crd, err := dynClient.Resource(entry.GVR()).Get(entry.Name, v1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if isCRDEstablished(crd) {
+			return nil
+		}
+		select {
+		case <-timeout:
+			return fmt.Errorf("timeout waiting for CRD [%s] to be established", entry.Name)
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func isCRDEstablished(crd *unstructured.Unstructured) bool {
+	conditions, _, _ := unstructured.NestedSlice(crd.Object, "status", "conditions")
+	for _, c := range conditions {
+		condition, ok := c.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if condition["type"] == "Established" && condition["status"] == "True" {
+			return true
+		}
+	}
+	return false
+}
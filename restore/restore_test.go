@@ -0,0 +1,62 @@
+package restore
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/rancher/system-tools/backup"
+)
+
+func TestSortEntries(t *testing.T) {
+	entries := []backup.Entry{
+		{Type: backup.EntryMarks, Group: "", Resource: "configmaps", Name: "marked"},
+		{Type: backup.EntryObject, Group: "rbac.authorization.k8s.io", Resource: "clusterroles", Name: "role"},
+		{Type: backup.EntryObject, Group: "management.cattle.io", Resource: "clusters", Name: "c-1"},
+		{Type: backup.EntryObject, Group: "", Resource: "namespaces", Name: "c-1"},
+		{Type: backup.EntryObject, Group: "apiextensions.k8s.io", Resource: "customresourcedefinitions", Name: "clusters.management.cattle.io"},
+		{Type: backup.EntryObject, Group: "", Resource: "secrets", Name: "secret"},
+		{Type: backup.EntryObject, Group: "notcattle.io", Resource: "things", Name: "thing"},
+		{Type: backup.EntryObject, Group: "project.cattle.io", Resource: "apps", Name: "app"},
+	}
+	crds, namespaces, cattleObjects, objects, marks := sortEntries(entries)
+	names := func(entries []backup.Entry) []string {
+		result := []string{}
+		for _, entry := range entries {
+			result = append(result, entry.Resource+"/"+entry.Name)
+		}
+		return result
+	}
+	tests := []struct {
+		name string
+		got  []backup.Entry
+		want []string
+	}{
+		{name: "crds", got: crds, want: []string{"customresourcedefinitions/clusters.management.cattle.io"}},
+		{name: "namespaces", got: namespaces, want: []string{"namespaces/c-1"}},
+		{name: "cattle objects", got: cattleObjects, want: []string{"clusters/c-1", "apps/app"}},
+		{name: "objects", got: objects, want: []string{"clusterroles/role", "secrets/secret", "things/thing"}},
+		{name: "marks", got: marks, want: []string{"configmaps/marked"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := names(tt.got); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("%s = %v, want %v", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMergeMarks(t *testing.T) {
+	labels := mergeMaps(map[string]string{"app": "new", "kept": "yes"}, map[string]string{"app": "old", "field.cattle.io/projectId": "p-1"})
+	want := map[string]string{"app": "new", "kept": "yes", "field.cattle.io/projectId": "p-1"}
+	if !reflect.DeepEqual(labels, want) {
+		t.Errorf("mergeMaps() = %v, want %v", labels, want)
+	}
+	if got := mergeMaps(nil, map[string]string{"a": "b"}); !reflect.DeepEqual(got, map[string]string{"a": "b"}) {
+		t.Errorf("mergeMaps(nil) = %v", got)
+	}
+	finalizers := mergeFinalizers([]string{"kubernetes"}, []string{"controller.cattle.io/foo", "kubernetes"})
+	if !reflect.DeepEqual(finalizers, []string{"kubernetes", "controller.cattle.io/foo"}) {
+		t.Errorf("mergeFinalizers() = %v", finalizers)
+	}
+}
@@ -1,11 +1,11 @@
 package templates
 
 const LogCollectorDSTemplate = `
-apiVersion: extensions/v1beta1
+apiVersion: apps/v1
 kind: DaemonSet
 metadata:
   name: log-collector
-  namespace: "cattle-system"
+  namespace: "kube-system"
   labels:
     tier: node
     k8s-app: log-collector
@@ -24,16 +24,6 @@ spec:
       - name: log-collector
         image: {{ .Image }}
         imagePullPolicy: IfNotPresent
-        command: ["sh", "-c", "mkdir /tmp/$NODE_NAME;\
-        for i in *;\
-        do \
-         service=$(echo $i | cut -d _ -f 1);\
-         log_file=$(readlink $i);\
-         cp $log_file /tmp/$NODE_NAME/${service}.log;\
-        done; cd /tmp/;\
-        tar cvf /tmp/$NODE_NAME.tar $NODE_NAME;\
-        touch /tmp/finished;\
-        sleep 1d"]
         securityContext:
           privileged: true
         readinessProbe:
@@ -43,11 +33,9 @@ spec:
             - /tmp/finished
           periodSeconds: 5
         volumeMounts:
-        - name: logs
-          mountPath: /logs
-        - name: containers
-          mountPath: /var/lib/docker/containers/
-        workingDir: /logs
+        - name: host
+          mountPath: /host
+          readOnly: true
         env:
         - name: NODE_NAME
           valueFrom:
@@ -56,14 +44,210 @@ spec:
       tolerations:
       - operator: Exists
       volumes:
-        - name: logs
+        - name: host
           hostPath:
-            path: /var/lib/rancher/rke/log/
-        - name: containers
-          hostPath:
-            path: /var/lib/docker/containers
+            path: /
+
+`
+
+// The log collection scripts run in the log-collector pods with the host
+// filesystem mounted at /host. Each collects the logs of its cluster provider
+// in /tmp/$NODE_NAME, followed by the steps of the host profile and
+// LogCollectorTail, which leaves them in /tmp/$NODE_NAME.tar. Logs are cut to
+// the SINCE and UNTIL UTC times, formatted as 2006-01-02T15:04:05, when set.
+const logCollectorHead = `
+mkdir -p /tmp/$NODE_NAME/journald
+cd /tmp/$NODE_NAME
+# journal <unit>: the journald logs of a host unit, when it has any
+journal() {
+  _unit=$1
+  set --
+  [ -z "$SINCE" ] || set -- "$@" --since "${SINCE%T*} ${SINCE#*T}"
+  [ -z "$UNTIL" ] || set -- "$@" --until "${UNTIL%T*} ${UNTIL#*T}"
+  TZ=UTC chroot /host journalctl -q -u "$_unit" --no-pager "$@" > journald/$_unit.log 2>/dev/null
+  [ -s journald/$_unit.log ] || rm -f journald/$_unit.log
+}
+# window <file>: the lines of a log file inside the time window. Timestamps are
+# read from the time of docker json logs, the first RFC3339 time of a line, or
+# the klog header, which has no year. Lines without one follow the line before.
+window() {
+  case "$1" in
+  *.gz) gzip -dc "$1" ;;
+  *) cat "$1" ;;
+  esac | awk -v since="$SINCE" -v until="$UNTIL" -v year="$YEAR" '
+  BEGIN { keep = (since == "") }
+  {
+    t = ""
+    if (match($0, /"time":"[0-9][0-9][0-9][0-9]-[0-9][0-9]-[0-9][0-9]T[0-9][0-9]:[0-9][0-9]:[0-9][0-9]/)) {
+      t = substr($0, RSTART + 8, 19)
+    } else if (match($0, /[0-9][0-9][0-9][0-9]-[0-9][0-9]-[0-9][0-9][T ][0-9][0-9]:[0-9][0-9]:[0-9][0-9]/)) {
+      t = substr($0, RSTART, 10) "T" substr($0, RSTART + 11, 8)
+    } else if (match($0, /^[IWEF][0-9][0-9][0-9][0-9] [0-9][0-9]:[0-9][0-9]:[0-9][0-9]/)) {
+      t = year "-" substr($0, 2, 2) "-" substr($0, 4, 2) "T" substr($0, 7, 8)
+    }
+    if (t != "") {
+      keep = (since == "" || t >= since) && (until == "" || t <= until)
+    }
+    if (keep) print
+  }'
+}
+# cutlog <file> <dest>: a log file cut to the time window, rotated logs are
+# decompressed when they are cut
+cutlog() {
+  if [ -z "$SINCE$UNTIL" ]; then
+    cp "$1" "$2"
+    return
+  fi
+  window "$1" > "${2%.gz}"
+}
+# pods: the pod logs in /var/log/pods, which are links to the container logs
+# on docker nodes
+pods() {
+  [ -d /host/var/log/pods ] || return 0
+  (cd /host/var/log/pods && find . \( -type f -o -type l \) -name '*.log*') | while read f; do
+    src=/host/var/log/pods/$f
+    link=$(readlink $src)
+    case "$link" in
+    /*) src=/host$link ;;
+    esac
+    mkdir -p pods/$(dirname $f)
+    cutlog $src pods/$f
+  done
+}
+# copy <host path> <dir>: a host file or directory, when it exists
+copy() {
+  [ -e /host$1 ] || return 0
+  mkdir -p $2
+  cp -r /host$1 $2/
+}
+# run <name> <command>: the output of a host command in host/<name>.txt, stopped
+# after a minute when the host has timeout
+run() {
+  mkdir -p host
+  if chroot /host sh -c 'command -v timeout' >/dev/null 2>&1; then
+    chroot /host timeout 60 sh -c "$2" > host/$1.txt 2>&1
+  else
+    chroot /host sh -c "$2" > host/$1.txt 2>&1
+  fi
+}
+# hostpath <host path>: a host file or directory, kept at its path under host/files
+hostpath() {
+  copy "$1" "host/files$(dirname "$1")"
+}
+# copylog <host file> <dir>: a host log file cut to the time window, when it exists
+copylog() {
+  [ -f /host$1 ] || return 0
+  mkdir -p $2
+  cutlog /host$1 $2/$(basename $1)
+}
+`
+
+const LogCollectorTail = `
+cd /tmp
+tar cf /tmp/$NODE_NAME.tar $NODE_NAME
+touch /tmp/finished
+sleep 1d
+`
+
+// RKE logs the Kubernetes components through the symlinks in
+// /var/lib/rancher/rke/log to their docker container logs.
+const RKELogCollectorScript = logCollectorHead + `
+for i in /host/var/lib/rancher/rke/log/*; do
+  [ -L "$i" ] || continue
+  service=$(basename $i | cut -d _ -f 1)
+  cutlog /host$(readlink $i) ${service}.log
+done
+journal docker
+`
+
+const RKE2LogCollectorScript = logCollectorHead + `
+pods
+for unit in rke2-server rke2-agent; do
+  journal $unit
+done
+copylog /var/lib/rancher/rke2/agent/containerd/containerd.log rke2
+copylog /var/lib/rancher/rke2/agent/logs/kubelet.log rke2
+copy /var/lib/rancher/rke2/agent/pod-manifests rke2
+`
+
+const K3sLogCollectorScript = logCollectorHead + `
+pods
+for unit in k3s k3s-agent; do
+  journal $unit
+done
+copylog /var/lib/rancher/k3s/agent/containerd/containerd.log k3s
+copy /var/lib/rancher/k3s/agent/pod-manifests k3s
+copy /var/lib/rancher/k3s/server/manifests k3s
+`
 
+const KubeadmLogCollectorScript = logCollectorHead + `
+pods
+for unit in kubelet containerd docker; do
+  journal $unit
+done
+copy /etc/kubernetes/manifests kubeadm
 `
+
+// Host profiles list the journald units, host commands and host paths the log
+// collection captures on each node, in the format of custom --profile files.
+const MinimalHostProfile = `
+commands:
+- name: uname
+  command: uname -a
+- name: uptime
+  command: uptime
+- name: df
+  command: df -h
+- name: free
+  command: free -m
+paths:
+- /etc/os-release
+`
+
+const DefaultHostProfile = `
+extends: minimal
+journal:
+- docker
+- containerd
+- kubelet
+commands:
+- name: dmesg
+  command: dmesg -T || dmesg
+- name: ip-addr
+  command: ip addr
+- name: ip-route
+  command: ip route
+- name: lsmod
+  command: lsmod
+- name: docker-info
+  command: docker info
+paths:
+- /etc/docker/daemon.json
+`
+
+const FullHostProfile = `
+extends: default
+commands:
+- name: iptables-save
+  command: iptables-save
+- name: ip6tables-save
+  command: ip6tables-save
+- name: sysctl
+  command: sysctl -a
+- name: ps
+  command: ps auxww
+- name: mount
+  command: mount
+- name: ss
+  command: ss -tanp
+- name: df-inodes
+  command: df -i
+paths:
+- /etc/resolv.conf
+- /etc/hosts
+- /etc/systemd/system/docker.service.d
+`
+
 const StatsDSTemplate = `
 apiVersion: extensions/v1beta1
 kind: DaemonSet
@@ -94,3 +278,257 @@ spec:
       tolerations:
       - operator: Exists
 `
+
+const NodeCleanupDSTemplate = `
+apiVersion: apps/v1
+kind: DaemonSet
+metadata:
+  name: node-cleanup
+  namespace: "kube-system"
+  labels:
+    tier: node
+    k8s-app: node-cleanup
+spec:
+  selector:
+    matchLabels:
+      tier: node
+      k8s-app: node-cleanup
+  template:
+    metadata:
+      labels:
+        tier: node
+        k8s-app: node-cleanup
+    spec:
+      hostPID: true
+      hostNetwork: true
+      containers:
+      - name: node-cleanup
+        image: {{ .Image }}
+        imagePullPolicy: IfNotPresent
+        command: ["sh", "-c", "sleep 1d"]
+        securityContext:
+          privileged: true
+        volumeMounts:
+        - name: host
+          mountPath: /host
+      tolerations:
+      - operator: Exists
+      volumes:
+        - name: host
+          hostPath:
+            path: /
+`
+
+// NodeCleanupScript is copied to the host and run as
+// node-cleanup.sh <plan|run|apply|release|cancel> <host root> <image> [step...]
+// plan prints "<step> <item>" for everything the steps would remove, run does
+// the same and schedules apply in a detached container that outlives the
+// cluster. apply waits to be released, then removes the items and logs
+// "<step> removed|failed <item>". release <seconds> <node> <event> [api,...]
+// starts the scheduled cleanup that many seconds later, and fails when the
+// scheduled cleanup isn't running anymore. When API addresses are given, apply
+// reports its per step counts as the <event> Node event, with the node
+// credentials. cancel removes the scheduled cleanup before it starts.
+const NodeCleanupScript = `#!/bin/sh
+MODE=$1
+ROOT=$2
+IMAGE=$3
+shift 3
+STEPS="$*"
+
+SCRIPT=/var/tmp/rancher-node-cleanup.sh
+LOG=/var/log/rancher-node-cleanup.log
+CLEANUP_CONTAINER=rancher-node-cleanup
+# written by release with the time the cleanup starts at
+TRIGGER=/var/tmp/rancher-node-cleanup.start
+# seconds a scheduled cleanup waits to be released before giving up
+RELEASE_TIMEOUT=900
+# the node certificates are removed with /etc/kubernetes, apply reports its
+# result with a copy of them
+NODE_SSL=/etc/kubernetes/ssl
+CREDENTIALS=/tmp/rancher-node-cleanup-ssl
+RESULT=/tmp/rancher-node-cleanup.result
+
+CONTAINER_PATTERN='^(k8s_|kubelet$|kube-|etcd|nginx-proxy$|service-sidekick$|rke-|share-mnt$|cattle-node-agent|rancher-agent)'
+ETCD_DIRS="/var/lib/etcd /opt/rke/etcd"
+CLEANUP_DIRS="/etc/kubernetes /opt/rke /var/lib/rancher /var/lib/kubelet /var/lib/cni /etc/cni /opt/cni /var/lib/calico /var/run/calico /run/flannel /var/log/containers /var/log/pods"
+MOUNT_PATTERN='^/(var/lib/kubelet|var/lib/rancher)'
+INTERFACES="flannel.1 flannel.4096 cni0 tunl0 vxlan.calico weave datapath vxlan-6784"
+CHAIN_PATTERN='KUBE-|CNI-|cali-|FLANNEL|flannel'
+
+host() {
+  chroot "$ROOT" "$@"
+}
+
+enabled() {
+  case " $STEPS " in
+    *" $1 "*) return 0 ;;
+  esac
+  return 1
+}
+
+existing_dirs() {
+  for d in $*; do
+    # /opt/rke/etcd is removed with /opt/rke unless etcd is kept
+    if [ "$d" = /opt/rke ] && ! enabled etcd && [ -d "$ROOT/opt/rke/etcd" ]; then
+      for sub in "$ROOT"/opt/rke/*; do
+        [ "$sub" = "$ROOT/opt/rke/etcd" ] || echo "${sub#$ROOT}"
+      done
+      continue
+    fi
+    [ -e "$ROOT$d" ] && echo "$d"
+  done
+}
+
+list_items() {
+  case $1 in
+    containers) host docker ps -a --format '{{.Names}}' | grep -E "$CONTAINER_PATTERN" | grep -v "^$CLEANUP_CONTAINER$" ;;
+    etcd) existing_dirs $ETCD_DIRS ;;
+    directories) existing_dirs $CLEANUP_DIRS ;;
+    interfaces) for i in $INTERFACES; do host ip link show "$i" >/dev/null 2>&1 && echo "$i"; done ;;
+    iptables) host iptables-save | grep -E "^:($CHAIN_PATTERN)" | cut -d ' ' -f 1 | tr -d : | sort -u ;;
+  esac
+}
+
+remove_item() {
+  case $1 in
+    containers) host docker rm -f "$2" >/dev/null ;;
+    etcd|directories) rm -rf "$ROOT$2" ;;
+    interfaces) host ip link delete "$2" ;;
+  esac
+}
+
+plan() {
+  for step in $STEPS; do
+    list_items "$step" | while read -r item; do
+      echo "$step $item"
+    done
+  done
+}
+
+wait_release() {
+  waited=0
+  # mv claims the trigger, so a release that is withdrawn is never half read
+  until mv "$ROOT$TRIGGER" "$ROOT$TRIGGER.taken" 2>/dev/null; do
+    if [ "$waited" -ge "$RELEASE_TIMEOUT" ]; then
+      echo "cleanup wasn't released within ${RELEASE_TIMEOUT}s, nothing was removed"
+      return 1
+    fi
+    sleep 1
+    waited=$((waited + 1))
+  done
+  read -r start NODE EVENT API < "$ROOT$TRIGGER.taken"
+  rm -f "$ROOT$TRIGGER.taken"
+  case $start in
+    ''|*[!0-9]*)
+      echo "invalid start time [$start], nothing was removed"
+      return 1
+      ;;
+  esac
+  while [ "$(date +%s)" -lt "$start" ]; do
+    sleep 1
+  done
+}
+
+save_credentials() {
+  [ -n "$API" ] || return 0
+  mkdir -p "$CREDENTIALS" &&
+    cp "$ROOT$NODE_SSL/kube-node.pem" "$ROOT$NODE_SSL/kube-node-key.pem" "$ROOT$NODE_SSL/kube-ca.pem" "$CREDENTIALS/"
+}
+
+report() {
+  [ -n "$API" ] || return 0
+  counts=""
+  for step in $STEPS; do
+    counts="$counts, $step $(grep -c "^$step removed " "$RESULT")/$(grep -c "^$step failed " "$RESULT")"
+  done
+  reason=NodeCleanupSucceeded
+  type=Normal
+  if grep -q "^[a-z]* failed " "$RESULT"; then
+    reason=NodeCleanupFailed
+    type=Warning
+  fi
+  now=$(date -u +%Y-%m-%dT%H:%M:%SZ)
+  event="{\"metadata\":{\"name\":\"$EVENT\",\"namespace\":\"default\"},\"involvedObject\":{\"kind\":\"Node\",\"name\":\"$NODE\"},\"reason\":\"$reason\",\"type\":\"$type\",\"message\":\"removed/failed:${counts#,}\",\"source\":{\"component\":\"$CLEANUP_CONTAINER\",\"host\":\"$NODE\"},\"firstTimestamp\":\"$now\",\"lastTimestamp\":\"$now\",\"count\":1}"
+  for api in $(echo "$API" | tr , ' '); do
+    if curl -sf --cacert "$CREDENTIALS/kube-ca.pem" --cert "$CREDENTIALS/kube-node.pem" --key "$CREDENTIALS/kube-node-key.pem" \
+      -H 'Content-Type: application/json' -X POST -d "$event" "$api/api/v1/namespaces/default/events" >/dev/null; then
+      echo "result reported to $api"
+      return 0
+    fi
+  done
+  echo "failed to report the result"
+}
+
+apply() {
+  for step in $STEPS; do
+    if [ "$step" = directories ]; then
+      # volumes of removed pods are still mounted under the kubelet directory
+      awk '{print $2}' /proc/1/mounts | grep -E "$MOUNT_PATTERN" | sort -r | while read -r m; do
+        host nsenter -t 1 -m -- umount "$m" || echo "$step failed umount $m"
+      done
+    fi
+    if [ "$step" = iptables ]; then
+      items=$(list_items iptables)
+      if host sh -c "iptables-save | grep -v -E '$CHAIN_PATTERN' | iptables-restore"; then
+        status=removed
+      else
+        status=failed
+      fi
+      for item in $items; do
+        echo "$step $status $item"
+      done
+      continue
+    fi
+    list_items "$step" | while read -r item; do
+      if remove_item "$step" "$item"; then
+        echo "$step removed $item"
+      else
+        echo "$step failed $item"
+      fi
+    done
+  done
+}
+
+case $MODE in
+  plan)
+    plan
+    ;;
+  run)
+    plan
+    host docker rm -f "$CLEANUP_CONTAINER" >/dev/null 2>&1
+    rm -f "$ROOT$TRIGGER"
+    host docker run -d --rm --name "$CLEANUP_CONTAINER" --privileged --pid=host --net=host -v /:/host "$IMAGE" \
+      sh -c "sh /host$SCRIPT apply /host $IMAGE $STEPS > /host$LOG 2>&1" >/dev/null || exit 1
+    echo "scheduled $LOG"
+    ;;
+  apply)
+    wait_release || exit 1
+    save_credentials
+    apply | tee "$RESULT"
+    report
+    ;;
+  release)
+    # a cleanup that gave up waiting or failed can't be released
+    if [ "$(host docker inspect -f '{{.State.Running}}' "$CLEANUP_CONTAINER" 2>/dev/null)" != true ]; then
+      echo "the scheduled cleanup isn't running anymore, see $LOG"
+      exit 1
+    fi
+    echo "$(($(date +%s) + $1)) $2 $3 $4" > "$ROOT$TRIGGER.tmp" && mv "$ROOT$TRIGGER.tmp" "$ROOT$TRIGGER" || exit 1
+    waited=0
+    while [ -e "$ROOT$TRIGGER" ]; do
+      if [ "$waited" -ge 10 ]; then
+        rm -f "$ROOT$TRIGGER"
+        echo "the scheduled cleanup didn't take the release, see $LOG"
+        exit 1
+      fi
+      sleep 1
+      waited=$((waited + 1))
+    done
+    ;;
+  cancel)
+    host docker rm -f "$CLEANUP_CONTAINER" >/dev/null 2>&1
+    rm -f "$ROOT$TRIGGER"
+    ;;
+esac
+`
@@ -1,7 +1,6 @@
 package utils
 
 import (
-	"archive/tar"
 	"bytes"
 	"fmt"
 	"html/template"
@@ -24,29 +23,39 @@ import (
 )
 
 const (
-	RKECluster = "RKE"
+	RKECluster     = "RKE"
+	RKE2Cluster    = "RKE2"
+	K3sCluster     = "k3s"
+	KubeadmCluster = "kubeadm"
+	CattleDomain   = "cattle.io"
 )
 
+// RetryTo calls f until it succeeds, retrying conflicts and transient API
+// errors with a backoff for up to a minute.
 func RetryTo(f func() error) error {
 	timeout := time.After(time.Second * 60)
-	step := time.Tick(time.Second * 2)
-	var err error
+	backoff := 200 * time.Millisecond
 	for {
+		err := f()
+		if err == nil || !isRetryable(err) {
+			return err
+		}
 		select {
-		case <-step:
-			if err = f(); err != nil {
-				if errors.IsConflict(err) {
-					continue
-				}
-				return err
-			}
-			return nil
+		case <-time.After(backoff):
 		case <-timeout:
 			return fmt.Errorf("Timout error, please try again:%v", err)
 		}
+		if backoff *= 2; backoff > 2*time.Second {
+			backoff = 2 * time.Second
+		}
 	}
 }
 
+func isRetryable(err error) bool {
+	return errors.IsConflict(err) || errors.IsTooManyRequests(err) || errors.IsServerTimeout(err) ||
+		errors.IsTimeout(err) || errors.IsServiceUnavailable(err) || errors.IsInternalError(err)
+}
+
 func RetryWithCount(f func() error, c int) error {
 	var err error
 	for i := 0; i < c; i++ {
@@ -59,28 +68,58 @@ func RetryWithCount(f func() error, c int) error {
 	return err
 }
 
-func isRKENode(node *corev1.Node) bool {
+func hasAnnotation(node *corev1.Node, domain string) bool {
 	for k := range node.Annotations {
-		if strings.Contains(k, "rke.cattle.io") {
+		if strings.Contains(k, domain) {
 			return true
 		}
 	}
 	return false
 }
 
+// getNodeProvider tells the provider of a node from its kubelet version, e.g.
+// v1.24.4+rke2r1, and from the annotations each provider sets on its nodes.
+func getNodeProvider(node *corev1.Node) string {
+	kubeletVersion := node.Status.NodeInfo.KubeletVersion
+	switch {
+	case strings.Contains(kubeletVersion, "+rke2") || hasAnnotation(node, "rke2.io/"):
+		return RKE2Cluster
+	case strings.Contains(kubeletVersion, "+k3s") || hasAnnotation(node, "k3s.io/"):
+		return K3sCluster
+	case hasAnnotation(node, "rke.cattle.io"):
+		return RKECluster
+	case hasAnnotation(node, "kubeadm.alpha.kubernetes.io"):
+		return KubeadmCluster
+	}
+	return ""
+}
+
+// IsCattleDomain is true for cattle.io and its subdomains, such as an API group
+// or the prefix of a label key.
+func IsCattleDomain(domain string) bool {
+	return domain == CattleDomain || strings.HasSuffix(domain, "."+CattleDomain)
+}
+
 func DecodeYamlResource(resource interface{}, yamlManifest string) error {
 	decoder := yamlutil.NewYAMLToJSONDecoder(bytes.NewReader([]byte(yamlManifest)))
 	return decoder.Decode(&resource)
 }
 
+// ReadFileFromPod streams a file of a pod to data, the stderr of cat is
+// returned with the error.
 func ReadFileFromPod(restConfig *rest.Config, pod corev1.Pod, fileName string, data io.Writer) error {
-	if err := PodExecCommand(restConfig, pod, []string{"/bin/cat", fileName}, data); err != nil {
-		return fmt.Errorf("error executing command on pod [%s/%s] on [%s]: %v", pod.Namespace, pod.Name, pod.Spec.NodeName, err)
+	stderr := bytes.Buffer{}
+	if err := podExec(restConfig, pod, []string{"/bin/cat", fileName}, data, &stderr, false); err != nil {
+		return fmt.Errorf("error executing command on pod [%s/%s] on [%s]: %v %s", pod.Namespace, pod.Name, pod.Spec.NodeName, err, strings.TrimSpace(stderr.String()))
 	}
 	return nil
 }
 
 func PodExecCommand(restConfig *rest.Config, pod corev1.Pod, command []string, stdout io.Writer) error {
+	return podExec(restConfig, pod, command, stdout, ioutil.Discard, true)
+}
+
+func podExec(restConfig *rest.Config, pod corev1.Pod, command []string, stdout, stderr io.Writer, tty bool) error {
 	restClient, err := corev1client.NewForConfig(restConfig)
 	if err != nil {
 		return err
@@ -105,8 +144,8 @@ func PodExecCommand(restConfig *rest.Config, pod corev1.Pod, command []string, s
 	err = execCmd.Stream(remotecommand.StreamOptions{
 		Stdin:  nil,
 		Stdout: stdout,
-		Stderr: ioutil.Discard, // I don't need stderr, exec would give me exit status if something broke
-		Tty:    true,
+		Stderr: stderr,
+		Tty:    tty,
 	})
 	if err != nil {
 		return err
@@ -121,47 +160,26 @@ func GetClusterProvider(client *kubernetes.Clientset) (string, error) {
 		return "", err
 	}
 	for _, node := range nodeList.Items {
-		if isRKENode(&node) {
-			return RKECluster, nil
+		if provider := getNodeProvider(&node); len(provider) != 0 {
+			return provider, nil
 		}
 	}
-	return "", fmt.Errorf("can't figure out cluster provider")
+	return "", fmt.Errorf("can't figure out cluster provider, only RKE, RKE2, k3s and kubeadm clusters are supported")
 }
 
 func GetClusterAgentImage(client *kubernetes.Clientset) (string, error) {
-	podList, err := client.CoreV1().Pods("cattle-system").List(v1.ListOptions{LabelSelector: "app=cattle-agent"})
-	if err != nil {
-		return "", err
-	}
-
-	for _, pod := range podList.Items {
-		agentImage := pod.Spec.Containers[0].Image
-		return agentImage, nil
-	}
-	return "", fmt.Errorf("can't find node agent image on this cluster")
-}
-
-func AddToTarBall(w io.Writer, r io.Reader) error {
-	tr := tar.NewReader(r)
-	tw := tar.NewWriter(w)
-	for {
-		h, err := tr.Next()
+	// clusters without the node agent, such as RKE2 and k3s, only run the cluster agent
+	for _, selector := range []string{"app=cattle-agent", "app=cattle-cluster-agent"} {
+		podList, err := client.CoreV1().Pods("cattle-system").List(v1.ListOptions{LabelSelector: selector})
 		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			return err
+			return "", err
 		}
-		if err := tw.WriteHeader(h); err != nil {
-			return err
+		for _, pod := range podList.Items {
+			agentImage := pod.Spec.Containers[0].Image
+			return agentImage, nil
 		}
-		if _, err := io.Copy(tw, tr); err != nil {
-			return err
-		}
-		// always flush
-		tw.Flush()
 	}
-	return nil
+	return "", fmt.Errorf("can't find node agent image on this cluster")
 }
 
 func CompileTemplateFromMap(tmplt string, configMap interface{}) (string, error) {
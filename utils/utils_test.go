@@ -0,0 +1,44 @@
+package utils
+
+import (
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestRetryTo(t *testing.T) {
+	resource := schema.GroupResource{Resource: "namespaces"}
+	tests := []struct {
+		name      string
+		errs      []error
+		wantCalls int
+		wantErr   bool
+	}{
+		{name: "success", errs: []error{nil}, wantCalls: 1},
+		{name: "conflict", errs: []error{errors.NewConflict(resource, "ns", nil), nil}, wantCalls: 2},
+		{name: "throttled", errs: []error{errors.NewTooManyRequests("slow down", 1), errors.NewServiceUnavailable("down"), nil}, wantCalls: 3},
+		{name: "not found", errs: []error{errors.NewNotFound(resource, "ns")}, wantCalls: 1, wantErr: true},
+		{name: "forbidden", errs: []error{errors.NewForbidden(resource, "ns", nil)}, wantCalls: 1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			start := time.Now()
+			err := RetryTo(func() error {
+				calls++
+				return tt.errs[calls-1]
+			})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("RetryTo() error = %v, want error %t", err, tt.wantErr)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("RetryTo() called f %d times, want %d", calls, tt.wantCalls)
+			}
+			if tt.wantCalls == 1 && time.Since(start) > 100*time.Millisecond {
+				t.Errorf("RetryTo() waited %s before the first call", time.Since(start))
+			}
+		})
+	}
+}